@@ -0,0 +1,89 @@
+// Package accesslog writes one JSON object per proxied request.
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// Entry is a line of the access log.
+type Entry struct {
+	Timestamp     time.Time `json:"timestamp"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	TraceID       string    `json:"trace_id,omitempty"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	Path          string    `json:"path"`
+	Route         string    `json:"route,omitempty"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Retries       int       `json:"retries,omitempty"`
+	Hedged        bool      `json:"hedged,omitempty"`
+	Coalesced     bool      `json:"coalesced,omitempty"`
+	Cache         string    `json:"cache,omitempty"`
+	Status        int       `json:"status"`
+	Bytes         int64     `json:"bytes"`
+	LatencyMs     float64   `json:"latency_ms"`
+	ClientIP      string    `json:"client_ip"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Logger writes access log entries to an io.Writer.
+type Logger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// New returns a Logger writing to w. Register its Log
+// method as an observer on the ReverseProxy.
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Log writes the entry of a proxied request, unless access
+// logging was disabled for the request's route.
+func (l *Logger) Log(info *directors.RequestInfo) {
+	if info.NoAccessLog {
+		return
+	}
+
+	var traceID string
+	if info.Trace != nil {
+		traceID = info.Trace.TraceID
+	}
+
+	line, err := json.Marshal(&Entry{
+		Timestamp:     info.Start.UTC(),
+		CorrelationID: info.CorrelationID,
+		TraceID:       traceID,
+		Method:        info.Method,
+		Host:          info.Host,
+		Path:          info.Path,
+		Route:         info.Route,
+		Upstream:      info.Upstream,
+		Retries:       info.Retries,
+		Hedged:        info.Hedged,
+		Coalesced:     info.Coalesced,
+		Cache:         info.CacheStatus,
+		Status:        info.StatusCode,
+		Bytes:         info.BytesWritten,
+		LatencyMs:     float64(info.Duration) / float64(time.Millisecond),
+		ClientIP:      info.ClientIP,
+		Error:         info.ErrorCode,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,97 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/directors"
+)
+
+func TestLogger(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	buf := &bytes.Buffer{}
+	rp := proxy.New()
+	rp.AddDirector(directors.Chain(
+		directors.NewCorrelation(),
+		directors.NewRouter(map[string]func(*http.Request){
+			"/users/:user_id": directors.NewSingleHost(upstream.URL),
+			"/health":         directors.Chain(directors.DisableAccessLog, directors.NewSingleHost(upstream.URL)),
+		}),
+	))
+	rp.AddObserver(New(buf).Log)
+
+	for _, path := range []string{"/users/user123", "/health", "/nomatch"} {
+		rp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost"+path, nil))
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Invalid number of entries. Expected:2 Got:%v\n%v", len(lines), buf)
+	}
+
+	entry := Entry{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Route != "/users/:user_id" || entry.Path != "/users/user123" || entry.Status != http.StatusOK ||
+		entry.Bytes != 5 || entry.Upstream != strings.TrimPrefix(upstream.URL, "http://") || entry.CorrelationID == "" {
+		t.Fatalf("Invalid entry: %+v", entry)
+	}
+
+	entry = Entry{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Status != http.StatusNotFound || entry.Error != directors.CodeInvalidTarget {
+		t.Fatalf("Invalid entry: %+v", entry)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.jsonl")
+	rf, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+		path + ".3": "",
+	}
+
+	for file, content := range expected {
+		b, _ := ioutil.ReadFile(file)
+		if string(b) != content {
+			t.Fatalf("Invalid content of %v. Expected:%q Got:%q", file, content, b)
+		}
+	}
+}
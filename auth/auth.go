@@ -68,7 +68,13 @@ func NewJWT(claims map[string]interface{}, validFor time.Duration) (string, erro
 // the claims in the JWT, and a bool indicating whether
 // the signature is verified successfully.
 func JWTClaims(tokenString string) (map[string]interface{}, bool) {
-	token, err := jwt.Parse(tokenString, signingKeyJWT)
+	return JWTClaimsWithKey(tokenString, JWTPrivateKey)
+}
+
+// JWTClaimsWithKey is the same as JWTClaims, except that the
+// signature is verified with key instead of JWTPrivateKey.
+func JWTClaimsWithKey(tokenString, key string) (map[string]interface{}, bool) {
+	token, err := jwt.Parse(tokenString, signingKeyJWT(key))
 	if err != nil {
 		return nil, false
 	}
@@ -76,13 +82,13 @@ func JWTClaims(tokenString string) (map[string]interface{}, bool) {
 	return token.Claims, token.Valid
 }
 
-func signingKeyJWT(token *jwt.Token) (interface{}, error) {
+func signingKeyJWT(key string) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		// only process HMAC signing for now
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
 
-	// only process HMAC signing for now
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		return []byte(key), nil
 	}
-
-	// TODO: add error checking to the type assertions above.
-	return []byte(JWTPrivateKey), nil
 }
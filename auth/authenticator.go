@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Role is the permission level of an authenticated client.
+type Role string
+
+// Roles of the configuration API.
+const (
+	RoleReadOnly  Role = "read-only"
+	RoleReadWrite Role = "read-write"
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	return r == RoleReadOnly || r == RoleReadWrite
+}
+
+// Allows reports whether a client with role r may access
+// an endpoint which requires the given role.
+func (r Role) Allows(required Role) bool {
+	switch r {
+	case RoleReadWrite:
+		return true
+	case RoleReadOnly:
+		return required == RoleReadOnly
+	default:
+		return false
+	}
+}
+
+// Identity is an authenticated client.
+type Identity struct {
+	Name string
+	Role Role
+}
+
+// ErrInvalidCredentials is returned when the request carries
+// credentials which can not be verified, or no credentials
+// accepted by any of the Authenticators.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator authenticates http requests.
+// It returns a nil Identity and nil error if the request doesn't carry
+// the kind of credentials the Authenticator handles, so the next
+// Authenticator can be tried.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to use ordinary functions as Authenticators.
+type AuthenticatorFunc func(req *http.Request) (*Identity, error)
+
+// Authenticate calls f(req).
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*Identity, error) {
+	return f(req)
+}
+
+// NewBearerTokenAuthenticator returns an Authenticator which accepts
+// the static tokens (keys of the map) in the Authorization header.
+func NewBearerTokenAuthenticator(tokens map[string]Identity) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Identity, error) {
+		token := BearerToken(req)
+		if token == "" {
+			return nil, nil
+		}
+
+		for t, identity := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				identity := identity
+				return &identity, nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+// NewJWTAuthenticator returns an Authenticator which accepts JWTs
+// signed with JWTPrivateKey in the Authorization header. The name of
+// the client is taken from the "sub" claim, the role from roleClaim.
+func NewJWTAuthenticator(roleClaim string) Authenticator {
+	return newJWTAuthenticator(roleClaim, JWTClaims)
+}
+
+// NewJWTAuthenticatorWithKey is the same as NewJWTAuthenticator,
+// except that the JWTs are verified with key.
+func NewJWTAuthenticatorWithKey(roleClaim, key string) Authenticator {
+	return newJWTAuthenticator(roleClaim, func(token string) (map[string]interface{}, bool) {
+		return JWTClaimsWithKey(token, key)
+	})
+}
+
+func newJWTAuthenticator(roleClaim string, verify func(token string) (map[string]interface{}, bool)) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Identity, error) {
+		token := BearerToken(req)
+		if strings.Count(token, ".") != 2 {
+			return nil, nil
+		}
+
+		claims, ok := verify(token)
+		if !ok {
+			return nil, ErrInvalidCredentials
+		}
+
+		name, _ := claims["sub"].(string)
+		role, _ := claims[roleClaim].(string)
+		if !Role(role).Valid() {
+			return nil, ErrInvalidCredentials
+		}
+
+		return &Identity{Name: name, Role: Role(role)}, nil
+	})
+}
+
+// NewClientCertAuthenticator returns an Authenticator which identifies
+// clients by the common name of their verified TLS client certificate.
+// The server must be configured to verify client certificates.
+func NewClientCertAuthenticator(identities map[string]Identity) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Identity, error) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			return nil, nil
+		}
+
+		commonName := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		identity, ok := identities[commonName]
+		if !ok {
+			return nil, nil
+		}
+		return &identity, nil
+	})
+}
+
+// Authenticate tries the authenticators in order and returns the
+// first Identity. It returns ErrInvalidCredentials if none of them
+// could authenticate the request.
+func Authenticate(req *http.Request, authenticators ...Authenticator) (*Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(req)
+		if err != nil {
+			return nil, err
+		}
+		if identity != nil {
+			return identity, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// WithIdentity returns a copy of req with the identity stored in its context.
+func WithIdentity(req *http.Request, identity *Identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), "auth.identity", identity))
+}
+
+// IdentityFromRequest returns the Identity stored by WithIdentity.
+func IdentityFromRequest(req *http.Request) (*Identity, bool) {
+	identity, ok := req.Context().Value("auth.identity").(*Identity)
+	return identity, ok
+}
+
+// BearerToken returns the token from the Authorization
+// header ("Bearer <token>") of the request.
+func BearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[7:])
+}
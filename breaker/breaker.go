@@ -0,0 +1,267 @@
+// Package breaker implements circuit breakers for upstream round trips.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// States of a Breaker.
+const (
+	Closed   = "closed"    // requests pass
+	Open     = "open"      // requests are rejected
+	HalfOpen = "half-open" // probe requests pass
+)
+
+// Outcome is the result of a request allowed by a Breaker.
+type Outcome int
+
+// Outcomes of requests.
+const (
+	Success Outcome = iota
+	Failure
+	Ignored // e.g. cancelled by the client, it's not counted
+)
+
+// Settings configure when a Breaker trips and recovers.
+type Settings struct {
+	// ConsecutiveFailures trips the breaker after that many
+	// failures in a row (default 5).
+	ConsecutiveFailures int
+
+	// ErrorRate trips the breaker when the ratio of failures
+	// exceeds it in a Window (default 10s) with at least
+	// MinRequests (default 20) requests. 0 disables it.
+	ErrorRate   float64
+	Window      time.Duration
+	MinRequests int
+
+	// OpenTimeout is the time the breaker stays open before
+	// it lets probe requests through (default 30s).
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of probe requests allowed
+	// in the half-open state (default 1). The breaker closes if
+	// all of them succeed and opens again on the first failure.
+	HalfOpenProbes int
+}
+
+func (s *Settings) setDefaults() {
+	if s.ConsecutiveFailures <= 0 {
+		s.ConsecutiveFailures = 5
+	}
+	if s.Window <= 0 {
+		s.Window = 10 * time.Second
+	}
+	if s.MinRequests <= 0 {
+		s.MinRequests = 20
+	}
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = 30 * time.Second
+	}
+	if s.HalfOpenProbes <= 0 {
+		s.HalfOpenProbes = 1
+	}
+}
+
+// Breaker is a circuit breaker of a single upstream.
+type Breaker struct {
+	sync.Mutex
+	settings Settings
+
+	state       string
+	consecutive int // failures in a row
+	windowStart time.Time
+	requests    int // in the window
+	failures    int // in the window
+	openedAt    time.Time
+	probes      int // in flight in half-open state
+	successes   int // of probes
+}
+
+// New returns a closed Breaker.
+func New(settings Settings) *Breaker {
+	settings.setDefaults()
+	return &Breaker{
+		settings:    settings,
+		state:       Closed,
+		windowStart: time.Now(),
+	}
+}
+
+// Allow reports whether a request may be sent. If it may, done must
+// be called with its outcome. Otherwise retryAfter is the time until
+// the breaker lets probe requests through, it's 0 while the probes
+// are in flight, as their outcome decides when requests are let
+// through again.
+func (b *Breaker) Allow() (done func(Outcome), retryAfter time.Duration, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	if b.state == Open {
+		if remaining := b.openedAt.Add(b.settings.OpenTimeout).Sub(now); remaining > 0 {
+			return nil, remaining, false
+		}
+		b.state, b.probes, b.successes = HalfOpen, 0, 0
+	}
+
+	if b.state == HalfOpen {
+		if b.probes >= b.settings.HalfOpenProbes {
+			return nil, 0, false
+		}
+		b.probes++
+		return b.doneProbe, 0, true
+	}
+
+	return b.done, 0, true
+}
+
+// done records the outcome of a request in the closed state.
+func (b *Breaker) done(outcome Outcome) {
+	if outcome == Ignored {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != Closed {
+		// the breaker was tripped by another request meanwhile
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowStart) > b.settings.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+
+	if outcome == Success {
+		b.consecutive = 0
+		return
+	}
+
+	b.failures++
+	b.consecutive++
+
+	if b.consecutive >= b.settings.ConsecutiveFailures {
+		b.trip(now)
+		return
+	}
+
+	if b.settings.ErrorRate > 0 && b.requests >= b.settings.MinRequests &&
+		float64(b.failures)/float64(b.requests) > b.settings.ErrorRate {
+		b.trip(now)
+	}
+}
+
+// doneProbe records the outcome of a probe request.
+func (b *Breaker) doneProbe(outcome Outcome) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != HalfOpen {
+		return
+	}
+
+	switch outcome {
+	case Ignored:
+		b.probes--
+
+	case Failure:
+		b.trip(time.Now())
+
+	case Success:
+		b.successes++
+		if b.successes >= b.settings.HalfOpenProbes {
+			b.state = Closed
+			b.consecutive, b.requests, b.failures = 0, 0, 0
+			b.windowStart = time.Now()
+		}
+	}
+}
+
+func (b *Breaker) trip(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+}
+
+// Snapshot is the state of a Breaker.
+type Snapshot struct {
+	State      string     `json:"state"`
+	Requests   int        `json:"requests"`            // in the current window
+	Failures   int        `json:"failures"`            // in the current window
+	OpenedAt   *time.Time `json:"opened_at,omitempty"` // nil while closed
+	RetryAfter string     `json:"retry_after,omitempty"`
+}
+
+// Snapshot returns the state of the Breaker.
+func (b *Breaker) Snapshot() Snapshot {
+	b.Lock()
+	defer b.Unlock()
+
+	snapshot := Snapshot{
+		State:    b.state,
+		Requests: b.requests,
+		Failures: b.failures,
+	}
+
+	if b.state != Closed {
+		openedAt := b.openedAt.UTC()
+		snapshot.OpenedAt = &openedAt
+	}
+	if b.state == Open {
+		if remaining := b.openedAt.Add(b.settings.OpenTimeout).Sub(time.Now()); remaining > 0 {
+			snapshot.RetryAfter = remaining.String()
+		} else {
+			// probes are let through by the next request
+			snapshot.State = HalfOpen
+		}
+	}
+	return snapshot
+}
+
+// Set keeps a Breaker for every upstream host.
+type Set struct {
+	sync.Mutex
+	settings Settings
+	breakers map[string]*Breaker
+}
+
+// NewSet returns a Set creating Breakers with the given settings.
+func NewSet(settings Settings) *Set {
+	return &Set{
+		settings: settings,
+		breakers: map[string]*Breaker{},
+	}
+}
+
+// Get returns the Breaker of the host.
+func (s *Set) Get(host string) *Breaker {
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.breakers[host]
+	if !ok {
+		b = New(s.settings)
+		s.breakers[host] = b
+	}
+	return b
+}
+
+// Snapshots returns the state of the Breakers by host.
+func (s *Set) Snapshots() map[string]Snapshot {
+	s.Lock()
+	breakers := make(map[string]*Breaker, len(s.breakers))
+	for host, b := range s.breakers {
+		breakers[host] = b
+	}
+	s.Unlock()
+
+	snapshots := make(map[string]Snapshot, len(breakers))
+	for host, b := range breakers {
+		snapshots[host] = b.Snapshot()
+	}
+	return snapshots
+}
@@ -0,0 +1,86 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func request(t *testing.T, b *Breaker, outcome Outcome) {
+	done, _, ok := b.Allow()
+	if !ok {
+		t.Fatalf("Expected the request to be allowed in state %s", b.Snapshot().State)
+	}
+	done(outcome)
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	b := New(Settings{ConsecutiveFailures: 3, OpenTimeout: 50 * time.Millisecond})
+
+	// failures must be consecutive, ignored requests don't count
+	request(t, b, Failure)
+	request(t, b, Failure)
+	request(t, b, Success)
+	request(t, b, Failure)
+	request(t, b, Ignored)
+	request(t, b, Failure)
+	if snapshot := b.Snapshot(); snapshot.State != Closed || snapshot.OpenedAt != nil {
+		t.Fatalf("Expected %s without opened_at, got %+v", Closed, snapshot)
+	}
+
+	request(t, b, Failure)
+	if snapshot := b.Snapshot(); snapshot.State != Open || snapshot.OpenedAt == nil {
+		t.Fatalf("Expected %s with opened_at, got %+v", Open, snapshot)
+	}
+
+	_, retryAfter, ok := b.Allow()
+	if ok || retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Fatalf("Expected the request to be rejected, got %v %v", ok, retryAfter)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	b := New(Settings{ErrorRate: 0.5, MinRequests: 10})
+
+	for i := 0; i < 9; i++ {
+		request(t, b, Success)
+		request(t, b, Failure)
+	}
+	if state := b.Snapshot().State; state != Closed {
+		t.Fatalf("Expected %s, got %s", Closed, state)
+	}
+
+	request(t, b, Failure)
+	if state := b.Snapshot().State; state != Open {
+		t.Fatalf("Expected %s, got %s", Open, state)
+	}
+}
+
+func TestHalfOpen(t *testing.T) {
+	b := New(Settings{ConsecutiveFailures: 1, OpenTimeout: 20 * time.Millisecond, HalfOpenProbes: 2})
+
+	request(t, b, Failure)
+	time.Sleep(25 * time.Millisecond)
+
+	// a failed probe opens the breaker again
+	request(t, b, Failure)
+	if _, _, ok := b.Allow(); ok {
+		t.Fatal("Expected the breaker to open after a failed probe")
+	}
+	time.Sleep(25 * time.Millisecond)
+
+	// only HalfOpenProbes requests are let through at the same time
+	first, _, _ := b.Allow()
+	second, _, _ := b.Allow()
+	if _, retryAfter, ok := b.Allow(); ok || retryAfter != 0 {
+		t.Fatalf("Expected only 2 probes and no retry after, got %v", retryAfter)
+	}
+
+	first(Success)
+	if state := b.Snapshot().State; state != HalfOpen {
+		t.Fatalf("Expected %s, got %s", HalfOpen, state)
+	}
+	second(Success)
+	if state := b.Snapshot().State; state != Closed {
+		t.Fatalf("Expected %s, got %s", Closed, state)
+	}
+}
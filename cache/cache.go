@@ -0,0 +1,486 @@
+// Package cache implements a shared HTTP cache (RFC 9111) for the
+// transport of the proxy. Responses are stored according to their
+// Cache-Control and Expires headers, stale responses are revalidated
+// with their ETag or Last-Modified validators, and stale-while-revalidate
+// lets stale responses be served while they are revalidated in the
+// background.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// Cache statuses of requests, reported in RequestInfo.CacheStatus.
+const (
+	StatusHit         = "hit"         // served from the cache
+	StatusStale       = "stale"       // served stale, revalidated in the background
+	StatusRevalidated = "revalidated" // served from the cache after a 304
+	StatusMiss        = "miss"        // sent upstream
+	StatusBypass      = "bypass"      // not cacheable
+)
+
+// Options configure a Cache.
+type Options struct {
+	// Store keeps the entries (default an LRU of 10000
+	// entries and 64MiB).
+	Store Store
+
+	// MaxEntryBytes is the size of the largest body which
+	// is stored (default 1MiB).
+	MaxEntryBytes int64
+}
+
+// Cache is a shared HTTP cache. Use Wrap to apply it to a transport.
+type Cache struct {
+	store         Store
+	maxEntryBytes int64
+
+	mu           sync.Mutex
+	revalidating map[string]bool // keys revalidated in the background
+}
+
+// New returns a Cache.
+func New(opts Options) *Cache {
+	if opts.Store == nil {
+		opts.Store = NewLRU(10000, 64<<20)
+	}
+	if opts.MaxEntryBytes <= 0 {
+		opts.MaxEntryBytes = 1 << 20
+	}
+
+	return &Cache{
+		store:         opts.Store,
+		maxEntryBytes: opts.MaxEntryBytes,
+		revalidating:  map[string]bool{},
+	}
+}
+
+// Key returns the cache key of the request: its host, the matched
+// route and its request URI ("example.com /api/* /api/a?b=c"), so the
+// targets of an upstream pool share the entries. Requests without a
+// route use the upstream URL instead of the route and request URI.
+func Key(req *http.Request) string {
+	resource := req.URL.String()
+	if route := directors.GetRequestInfo(req).Route; route != "" {
+		resource = route + " " + req.URL.RequestURI()
+	}
+	return req.Host + " " + resource
+}
+
+// Wrap returns a RoundTripper which serves requests from the cache
+// and sends them to next otherwise.
+func (c *Cache) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &transport{cache: c, next: next}
+}
+
+// Purge deletes the entry with the key, including its variants.
+// It returns the number of deleted entries.
+func (c *Cache) Purge(key string) int {
+	return c.purge(func(k string, entry *Entry) bool {
+		return k == key || strings.HasPrefix(k, key+"\n")
+	})
+}
+
+// PurgeRoute deletes the entries stored for a route definition.
+// It returns the number of deleted entries.
+func (c *Cache) PurgeRoute(route string) int {
+	return c.purge(func(key string, entry *Entry) bool {
+		return entry.Route == route
+	})
+}
+
+// PurgeAll deletes all entries.
+func (c *Cache) PurgeAll() int {
+	return c.purge(func(key string, entry *Entry) bool {
+		return true
+	})
+}
+
+func (c *Cache) purge(match func(key string, entry *Entry) bool) int {
+	purged := 0
+	c.store.Range(func(key string, entry *Entry) bool {
+		if match(key, entry) {
+			c.store.Delete(key)
+			if entry.StatusCode != 0 {
+				purged++
+			}
+		}
+		return true
+	})
+	return purged
+}
+
+// Entries returns the number of stored responses by route.
+func (c *Cache) Entries() map[string]int {
+	entries := map[string]int{}
+	c.store.Range(func(key string, entry *Entry) bool {
+		if entry.StatusCode != 0 {
+			entries[entry.Route]++
+		}
+		return true
+	})
+	return entries
+}
+
+// lookup returns the entry of the request, selecting
+// the variant if the response varies.
+func (c *Cache) lookup(key string, req *http.Request) (*Entry, bool) {
+	entry, ok := c.store.Get(key)
+	if ok && entry.StatusCode == 0 {
+		entry, ok = c.store.Get(key + variantKey(entry.Vary, req))
+	}
+	return entry, ok
+}
+
+// put stores the entry of the request.
+func (c *Cache) put(key string, req *http.Request, entry *Entry) {
+	entry.Vary = varyHeaders(entry.Header)
+	if len(entry.Vary) == 0 {
+		c.store.Set(key, entry)
+		return
+	}
+
+	c.store.Set(key, &Entry{Vary: entry.Vary, Route: entry.Route})
+	c.store.Set(key+variantKey(entry.Vary, req), entry)
+}
+
+type transport struct {
+	cache *Cache
+	next  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.cache
+	info := directors.GetRequestInfo(req)
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		// unsafe methods invalidate the stored responses
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			c.Purge(Key(req))
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		info.CacheStatus = StatusBypass
+		return t.next.RoundTrip(req)
+	}
+
+	key := Key(req)
+	entry, ok := c.lookup(key, req)
+	if !ok {
+		if reqCC.has("only-if-cached") {
+			info.CacheStatus = StatusMiss
+			return gatewayTimeout(req), nil
+		}
+		return t.fetch(key, req)
+	}
+
+	now := time.Now()
+	age, freshness := entry.age(now), entry.freshness()
+	respCC := parseCacheControl(entry.Header)
+	noCache := reqCC.has("no-cache") || respCC.has("no-cache") || req.Header.Get("Pragma") == "no-cache"
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		noCache = true
+	}
+
+	if !noCache && age < freshness {
+		info.CacheStatus = StatusHit
+		return entry.response(req, age), nil
+	}
+
+	// stale-while-revalidate doesn't apply to responses which
+	// must be revalidated
+	mustRevalidate := noCache || respCC.has("must-revalidate") || respCC.has("proxy-revalidate")
+	if swr, ok := respCC.seconds("stale-while-revalidate"); ok && !mustRevalidate && age < freshness+swr {
+		info.CacheStatus = StatusStale
+		t.revalidateInBackground(key, req, entry)
+		return entry.response(req, age), nil
+	}
+
+	if reqCC.has("only-if-cached") {
+		info.CacheStatus = StatusMiss
+		return gatewayTimeout(req), nil
+	}
+	return t.revalidate(key, req, entry)
+}
+
+// fetch sends the request upstream and stores the response.
+func (t *transport) fetch(key string, req *http.Request) (*http.Response, error) {
+	directors.GetRequestInfo(req).CacheStatus = StatusMiss
+
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.store(key, req, resp, requestTime)
+	return resp, nil
+}
+
+// revalidate sends the request upstream with the validators of the
+// entry. If the upstream responds with 304, the entry is refreshed
+// and served.
+func (t *transport) revalidate(key string, req *http.Request, entry *Entry) (*http.Response, error) {
+	info := directors.GetRequestInfo(req)
+
+	conditional := req.Clone(req.Context())
+	if !setValidators(conditional, entry) {
+		return t.fetch(key, req)
+	}
+
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(conditional)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusNotModified {
+		info.CacheStatus = StatusMiss
+		t.store(key, req, resp, requestTime)
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	refreshed := entry.refresh(resp, requestTime)
+	t.cache.put(key, req, refreshed)
+
+	info.CacheStatus = StatusRevalidated
+	return refreshed.response(req, refreshed.age(time.Now())), nil
+}
+
+// revalidateInBackground refreshes the entry without
+// delaying the request. Only one revalidation of a key
+// is in flight at a time.
+func (t *transport) revalidateInBackground(key string, req *http.Request, entry *Entry) {
+	c := t.cache
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	// the request must outlive the one of the client, it keeps the
+	// values set by the directors with a RequestInfo of its own
+	info := directors.GetRequestInfo(req)
+	ctx, cancel := context.WithTimeout(detachedContext{req.Context()}, time.Minute)
+	background := directors.WithRequestInfo(req.Clone(ctx), &directors.RequestInfo{
+		Start:          time.Now(),
+		Method:         info.Method,
+		Host:           info.Host,
+		Path:           info.Path,
+		ClientIP:       info.ClientIP,
+		Route:          info.Route,
+		CorrelationID:  info.CorrelationID,
+		ResponseHeader: http.Header{},
+	})
+	background.Body = nil
+
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+
+		resp, err := t.revalidate(key, background, entry)
+		if err != nil {
+			log.Printf("cache: revalidating %s: %v", key, err)
+			return
+		}
+		// the response is stored when its body is read
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// detachedContext keeps the values of a context
+// without its deadline and cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// store stores the response if it's allowed to. The body is stored
+// when it's completely read by the client.
+func (t *transport) store(key string, req *http.Request, resp *http.Response, requestTime time.Time) {
+	if !storable(req, resp) || resp.ContentLength > t.cache.maxEntryBytes {
+		return
+	}
+
+	entry := &Entry{
+		StatusCode:   resp.StatusCode,
+		Header:       cloneHeader(resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		Route:        directors.GetRequestInfo(req).Route,
+	}
+
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		limit:      t.cache.maxEntryBytes,
+		complete: func(body []byte) {
+			entry.Body = body
+			t.cache.put(key, req, entry)
+		},
+	}
+}
+
+// storable reports whether the response can be stored
+// by a shared cache (RFC 9111 section 3).
+func storable(req *http.Request, resp *http.Response) bool {
+	switch {
+	case req.Method != "GET", resp.StatusCode < 200,
+		resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	// responses setting cookies are specific to the client
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	if vary := varyHeaders(resp.Header); len(vary) == 1 && vary[0] == "*" {
+		return false
+	}
+
+	if req.Header.Get("Authorization") != "" &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	return cc.has("public") || cc.has("max-age") || cc.has("s-maxage") ||
+		resp.Header.Get("Expires") != "" || heuristicallyCacheable[resp.StatusCode]
+}
+
+// setValidators adds the conditional headers for revalidating the
+// entry to the request. It reports whether the entry has validators.
+func setValidators(req *http.Request, entry *Entry) bool {
+	ok := false
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+		ok = true
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+		ok = true
+	}
+	return ok
+}
+
+// refresh returns a copy of the entry updated with
+// the headers of a 304 response.
+func (e *Entry) refresh(resp *http.Response, requestTime time.Time) *Entry {
+	refreshed := *e
+	refreshed.Header = cloneHeader(e.Header)
+	for key, values := range resp.Header {
+		// the length of the body is not changed by a 304
+		if key != "Content-Length" {
+			refreshed.Header[key] = values
+		}
+	}
+	refreshed.RequestTime = requestTime
+	refreshed.ResponseTime = time.Now()
+	return &refreshed
+}
+
+// response returns the response of the entry for the request.
+func (e *Entry) response(req *http.Request, age time.Duration) *http.Response {
+	header := cloneHeader(e.Header)
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+
+	body := e.Body
+	if req.Method == "HEAD" {
+		body = nil
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// gatewayTimeout is the response to only-if-cached
+// requests which can't be served from the cache.
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 " + http.StatusText(http.StatusGatewayTimeout),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// recordingBody records the body while it's read, and calls
+// complete with it if it's read to the end within the limit.
+type recordingBody struct {
+	io.ReadCloser
+	limit    int64
+	buf      bytes.Buffer
+	exceeded bool
+	complete func(body []byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.exceeded {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.exceeded = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !b.exceeded && b.complete != nil {
+		b.complete(b.buf.Bytes())
+		b.complete = nil
+	}
+	return n, err
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// upstream counts the requests and responds
+// with the headers returned by respond.
+type upstream struct {
+	requests int
+	respond  func(req *http.Request) (int, http.Header)
+}
+
+func (u *upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.requests++
+	status, header := u.respond(req)
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	rec := httptest.NewRecorder()
+	for key, values := range header {
+		rec.Header()[key] = values
+	}
+	rec.WriteHeader(status)
+	if status != http.StatusNotModified {
+		rec.WriteString("body " + strconv.Itoa(u.requests))
+	}
+	return rec.Result(), nil
+}
+
+// get sends a GET request through the cache
+// and returns the status and body.
+func get(t *testing.T, rt http.RoundTripper, header http.Header) (int, string) {
+	req := httptest.NewRequest("GET", "http://upstream/a", nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestFreshness(t *testing.T) {
+	u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}
+	}}
+	rt := New(Options{}).Wrap(u)
+
+	for i := 0; i < 3; i++ {
+		if _, body := get(t, rt, nil); body != "body 1" {
+			t.Fatalf("Expected the stored response, got %q", body)
+		}
+	}
+
+	// no-cache requests are revalidated, without validators
+	// the response is fetched again
+	if _, body := get(t, rt, http.Header{"Cache-Control": {"no-cache"}}); body != "body 2" {
+		t.Fatalf("Expected a new response, got %q", body)
+	}
+}
+
+func TestNotStorable(t *testing.T) {
+	for _, header := range []http.Header{
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+	} {
+		u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+			return http.StatusOK, header
+		}}
+		rt := New(Options{}).Wrap(u)
+
+		get(t, rt, nil)
+		get(t, rt, nil)
+		if u.requests != 2 {
+			t.Fatalf("Expected %v not to be stored", header)
+		}
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+		header := http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return http.StatusNotModified, header
+		}
+		return http.StatusOK, header
+	}}
+	rt := New(Options{}).Wrap(u)
+
+	get(t, rt, nil)
+	status, body := get(t, rt, nil)
+	if status != http.StatusOK || body != "body 1" || u.requests != 2 {
+		t.Fatalf("Expected the revalidated response, got %v %q after %v requests", status, body, u.requests)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	revalidated := make(chan string, 1)
+	u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+		if req.Header.Get("If-None-Match") != "" {
+			revalidated <- directors.GetRequestInfo(req).Route
+		}
+		return http.StatusOK, http.Header{
+			"Cache-Control": {"max-age=1, stale-while-revalidate=60"},
+			"Etag":          {`"v1"`},
+			// already stale
+			"Age": {"2"},
+		}
+	}}
+	c := New(Options{})
+	rt := c.Wrap(u)
+
+	get := func() string {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req := httptest.NewRequest("GET", "http://upstream/a", nil).WithContext(ctx)
+		req = directors.WithRequestInfo(req, &directors.RequestInfo{Route: "/a", ResponseHeader: http.Header{}})
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	get()
+	if body := get(); body != "body 1" {
+		t.Fatalf("Expected the stale response, got %q", body)
+	}
+
+	// the revalidation outlives the request of the client
+	select {
+	case route := <-revalidated:
+		if route != "/a" {
+			t.Fatalf("Expected the route of the request, got %q", route)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a revalidation in the background")
+	}
+}
+
+func TestVary(t *testing.T) {
+	u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}
+	}}
+	rt := New(Options{}).Wrap(u)
+
+	en := http.Header{"Accept-Language": {"en"}}
+	de := http.Header{"Accept-Language": {"de"}}
+
+	get(t, rt, en)
+	get(t, rt, de)
+	_, enBody := get(t, rt, en)
+	_, deBody := get(t, rt, de)
+	if enBody != "body 1" || deBody != "body 2" {
+		t.Fatalf("Expected a stored response per variant, got %q and %q", enBody, deBody)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}
+	}}
+	c := New(Options{})
+	rt := c.Wrap(u)
+
+	get(t, rt, nil)
+	if purged := c.Purge("upstream http://upstream/a"); purged != 1 {
+		t.Fatalf("Expected 1 purged entry, got %v", purged)
+	}
+
+	// unsafe methods invalidate the stored response
+	get(t, rt, nil)
+	resp, _ := rt.RoundTrip(httptest.NewRequest("POST", "http://upstream/a", nil))
+	resp.Body.Close()
+	if _, body := get(t, rt, nil); body != "body 4" {
+		t.Fatalf("Expected the response to be invalidated, got %q", body)
+	}
+}
+
+func TestKeyOfRoute(t *testing.T) {
+	u := &upstream{respond: func(req *http.Request) (int, http.Header) {
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}
+	}}
+	c := New(Options{})
+	rt := c.Wrap(u)
+
+	// the targets of a route share the stored response
+	for _, target := range []string{"http://upstream1/a?b=c", "http://upstream2/a?b=c"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Host = "example.com"
+		req = directors.WithRequestInfo(req, &directors.RequestInfo{Route: "/a", ResponseHeader: http.Header{}})
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	if u.requests != 1 {
+		t.Fatalf("Expected 1 upstream request, got %v", u.requests)
+	}
+	if purged := c.Purge("example.com /a /a?b=c"); purged != 1 {
+		t.Fatalf("Expected 1 purged entry, got %v", purged)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	lru := NewLRU(2, 0)
+	lru.Set("a", &Entry{StatusCode: 200})
+	lru.Set("b", &Entry{StatusCode: 200})
+	lru.Get("a")
+	lru.Set("c", &Entry{StatusCode: 200})
+
+	if _, ok := lru.Get("b"); ok {
+		t.Fatal("Expected the least recently used entry to be evicted")
+	}
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatal("Expected the recently used entry to be kept")
+	}
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a stored response.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// RequestTime and ResponseTime are the times the request
+	// was sent and the response was received, for the age.
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// Route is the route definition the response was stored for.
+	Route string
+
+	// Vary are the request headers the response varies by. Entries
+	// with Vary and no StatusCode point to the stored variants.
+	Vary []string
+}
+
+// size is an estimate of the memory used by the entry.
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body)) + 64
+	for key, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(key) + len(value))
+		}
+	}
+	return size
+}
+
+// Store keeps the entries of a Cache. Stored entries must not
+// be modified, they are replaced instead.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry)
+	Delete(key string)
+
+	// Range calls f for the stored entries until it returns false.
+	// Entries may be deleted by f.
+	Range(f func(key string, entry *Entry) bool)
+}
+
+// LRU is an in-memory Store which evicts the least recently
+// used entries when it's full.
+type LRU struct {
+	sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	list       *list.List // of *lruItem, most recently used first
+	items      map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// NewLRU returns an LRU which keeps up to maxEntries entries
+// of maxBytes in total (estimated), 0 means no limit.
+func NewLRU(maxEntries int, maxBytes int64) *LRU {
+	return &LRU{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		list:       list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// Get implements Store.
+func (lru *LRU) Get(key string) (*Entry, bool) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	element, ok := lru.items[key]
+	if !ok {
+		return nil, false
+	}
+	lru.list.MoveToFront(element)
+	return element.Value.(*lruItem).entry, true
+}
+
+// Set implements Store.
+func (lru *LRU) Set(key string, entry *Entry) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	if element, ok := lru.items[key]; ok {
+		lru.remove(element)
+	}
+
+	item := &lruItem{key: key, entry: entry, size: entry.size()}
+	lru.items[key] = lru.list.PushFront(item)
+	lru.bytes += item.size
+
+	for lru.list.Len() > 1 && (lru.maxEntries > 0 && lru.list.Len() > lru.maxEntries ||
+		lru.maxBytes > 0 && lru.bytes > lru.maxBytes) {
+		lru.remove(lru.list.Back())
+	}
+}
+
+// Delete implements Store.
+func (lru *LRU) Delete(key string) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	if element, ok := lru.items[key]; ok {
+		lru.remove(element)
+	}
+}
+
+// Range implements Store.
+func (lru *LRU) Range(f func(key string, entry *Entry) bool) {
+	lru.Lock()
+	items := make([]*lruItem, 0, lru.list.Len())
+	for element := lru.list.Front(); element != nil; element = element.Next() {
+		items = append(items, element.Value.(*lruItem))
+	}
+	lru.Unlock()
+
+	for _, item := range items {
+		if !f(item.key, item.entry) {
+			return
+		}
+	}
+}
+
+// Len returns the number of entries and their estimated size.
+func (lru *LRU) Len() (entries int, bytes int64) {
+	lru.Lock()
+	defer lru.Unlock()
+
+	return lru.list.Len(), lru.bytes
+}
+
+func (lru *LRU) remove(element *list.Element) {
+	item := lru.list.Remove(element).(*lruItem)
+	delete(lru.items, item.key)
+	lru.bytes -= item.size
+}
@@ -0,0 +1,197 @@
+// Package capture records request/response pairs passing through
+// the proxy and replays them against a target for comparison.
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRedactHeaders are the headers redacted when no
+// headers are given in the Options.
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redacted replaces the values of redacted headers.
+const redacted = "REDACTED"
+
+// Exchange is a recorded request/response pair,
+// one line of a capture file.
+type Exchange struct {
+	Timestamp time.Time `json:"timestamp"`
+	LatencyMs float64   `json:"latency_ms"`
+	Request   Request   `json:"request"`
+	Response  Response  `json:"response"`
+}
+
+// Request is a recorded request. Body is capped at
+// the maximum body size, BodyTruncated is set if it's cut.
+type Request struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Host          string      `json:"host"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	StatusCode    int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// Options configure a Recorder.
+type Options struct {
+	MaxBodySize   int64    // bytes of the bodies recorded
+	RedactHeaders []string // header values which are not recorded
+}
+
+// Recorder writes the exchanges as JSON lines to an io.Writer.
+type Recorder struct {
+	sync.Mutex
+	w       io.Writer
+	options Options
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer, options Options) *Recorder {
+	if options.RedactHeaders == nil {
+		options.RedactHeaders = DefaultRedactHeaders
+	}
+	return &Recorder{w: w, options: options}
+}
+
+// Handler wraps an http.Handler (usually the ReverseProxy)
+// recording every request and response passing through it.
+func (r *Recorder) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		exchange := &Exchange{
+			Timestamp: time.Now().UTC(),
+			Request: Request{
+				Method: req.Method,
+				URL:    req.URL.RequestURI(),
+				Host:   req.Host,
+				Header: r.redact(req.Header),
+			},
+		}
+
+		requestBody := &cappedBuffer{max: r.options.MaxBodySize}
+		if req.Body != nil {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, requestBody), req.Body}
+		}
+
+		rec := &responseCapture{ResponseWriter: rw, body: &cappedBuffer{max: r.options.MaxBodySize}}
+		next.ServeHTTP(rec, req)
+
+		exchange.LatencyMs = float64(time.Since(exchange.Timestamp)) / float64(time.Millisecond)
+		exchange.Request.Body, exchange.Request.BodyTruncated = requestBody.Bytes(), requestBody.truncated
+		exchange.Response = Response{
+			StatusCode:    rec.statusCode,
+			Header:        r.redact(rw.Header()),
+			Body:          rec.body.Bytes(),
+			BodyTruncated: rec.body.truncated,
+		}
+
+		r.write(exchange)
+	})
+}
+
+func (r *Recorder) write(exchange *Exchange) {
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *Recorder) redact(header http.Header) http.Header {
+	h := http.Header{}
+	for key, values := range header {
+		h[key] = values
+		for _, redactHeader := range r.options.RedactHeaders {
+			if strings.EqualFold(key, redactHeader) {
+				h[key] = []string{redacted}
+			}
+		}
+	}
+	return h
+}
+
+// cappedBuffer keeps the first max bytes written to it.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(b []byte) (int, error) {
+	if remaining := cb.max - int64(cb.Len()); int64(len(b)) > remaining {
+		cb.truncated = true
+		if remaining > 0 {
+			cb.Buffer.Write(b[:remaining])
+		}
+		return len(b), nil
+	}
+	return cb.Buffer.Write(b)
+}
+
+// responseCapture records the status code and the
+// body written to the client.
+type responseCapture struct {
+	http.ResponseWriter
+	statusCode int
+	body       *cappedBuffer
+}
+
+func (rc *responseCapture) WriteHeader(statusCode int) {
+	if rc.statusCode == 0 {
+		rc.statusCode = statusCode
+	}
+	rc.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	if rc.statusCode == 0 {
+		rc.statusCode = http.StatusOK
+	}
+	rc.body.Write(b)
+	return rc.ResponseWriter.Write(b)
+}
+
+func (rc *responseCapture) Flush() {
+	if flusher, ok := rc.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach
+// the original ResponseWriter.
+func (rc *responseCapture) Unwrap() http.ResponseWriter {
+	return rc.ResponseWriter
+}
+
+// readBody reads and closes the body, returning
+// at most max bytes.
+func readBody(body io.ReadCloser, max int64) ([]byte, error) {
+	defer body.Close()
+	return ioutil.ReadAll(io.LimitReader(body, max))
+}
@@ -0,0 +1,69 @@
+package capture
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	version := "v1"
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("Authorization") != "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Write([]byte(version + ":" + req.URL.Path + ":" + string(body)))
+	}))
+	defer upstream.Close()
+
+	buf := &bytes.Buffer{}
+	recorder := NewRecorder(buf, Options{MaxBodySize: 1024})
+	handler := recorder.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Header.Del("Authorization")
+		resp, err := http.Post(upstream.URL+req.URL.Path, "text/plain", req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		rw.WriteHeader(resp.StatusCode)
+		rw.Write(body)
+	}))
+
+	for _, path := range []string{"/a", "/b"} {
+		req := httptest.NewRequest("POST", "http://localhost"+path, strings.NewReader("payload"))
+		req.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("Authorization header is not redacted:\n%v", buf)
+	}
+
+	captured := buf.String()
+	results, err := Replay(strings.NewReader(captured), upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range results {
+		if !result.StatusMatch || !result.BodyMatch {
+			t.Fatalf("Expected matching replay: %+v", result)
+		}
+	}
+
+	version = "v2"
+	results, err = Replay(strings.NewReader(captured), upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || !results[0].StatusMatch || results[0].BodyMatch {
+		t.Fatalf("Expected body differences: %+v", results[0])
+	}
+}
@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Result is the outcome of replaying a recorded Exchange.
+type Result struct {
+	Method            string  `json:"method"`
+	URL               string  `json:"url"`
+	RecordedStatus    int     `json:"recorded_status"`
+	Status            int     `json:"status"`
+	StatusMatch       bool    `json:"status_match"`
+	BodyMatch         bool    `json:"body_match"`
+	RecordedLatencyMs float64 `json:"recorded_latency_ms"`
+	LatencyMs         float64 `json:"latency_ms"`
+	Error             string  `json:"error,omitempty"`
+}
+
+// Replay sends the requests recorded in r to target (e.g.
+// "http://localhost:9001") and compares the responses with the
+// recorded ones. Bodies are compared up to the recorded size.
+// Requests with truncated bodies are not replayed.
+func Replay(r io.Reader, target string, client *http.Client) ([]*Result, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	results := []*Result{}
+	decoder := json.NewDecoder(r)
+	for decoder.More() {
+		exchange := &Exchange{}
+		if err := decoder.Decode(exchange); err != nil {
+			return results, err
+		}
+		results = append(results, replay(exchange, strings.TrimSuffix(target, "/"), client))
+	}
+
+	return results, nil
+}
+
+func replay(exchange *Exchange, target string, client *http.Client) *Result {
+	result := &Result{
+		Method:            exchange.Request.Method,
+		URL:               exchange.Request.URL,
+		RecordedStatus:    exchange.Response.StatusCode,
+		RecordedLatencyMs: exchange.LatencyMs,
+	}
+
+	if exchange.Request.BodyTruncated {
+		result.Error = "request body was truncated when recorded"
+		return result
+	}
+
+	req, err := http.NewRequest(exchange.Request.Method, target+exchange.Request.URL, bytes.NewReader(exchange.Request.Body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	req.Host = exchange.Request.Host
+	for key, values := range exchange.Request.Header {
+		if len(values) == 1 && values[0] == redacted {
+			continue
+		}
+		req.Header[key] = values
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	recordedBody := exchange.Response.Body
+	limit := int64(len(recordedBody))
+	if !exchange.Response.BodyTruncated {
+		// read one more byte to detect longer bodies
+		limit++
+	}
+
+	body, err := readBody(resp.Body, limit)
+	result.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	result.Status = resp.StatusCode
+	result.StatusMatch = resp.StatusCode == exchange.Response.StatusCode
+	result.BodyMatch = bytes.Equal(body, recordedBody)
+	return result
+}
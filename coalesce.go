@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// flight is a request sent upstream on behalf of the
+// identical requests which arrive while it's in flight.
+type flight struct {
+	done chan struct{}
+
+	// set before done is closed
+	req       *http.Request
+	upstream  string
+	resp      *http.Response // nil if it can't be shared
+	body      []byte
+	err       error
+	cancelled bool // by the client, the waiters send the request again
+}
+
+// coalesce sends the request upstream unless an identical request
+// is in flight, in which case it waits for that one's response.
+func (rt *roundTripper) coalesce(req *http.Request, policy *directors.CoalescePolicy) (*http.Response, error) {
+	key, ok := policy.Key(req)
+	if !ok {
+		return rt.dispatch(req)
+	}
+
+	rt.mu.Lock()
+	if f, ok := rt.flights[key]; ok {
+		rt.mu.Unlock()
+		return rt.wait(req, policy, f)
+	}
+	f := &flight{done: make(chan struct{})}
+	rt.flights[key] = f
+	rt.mu.Unlock()
+
+	resp, err := rt.lead(req, policy, f)
+
+	rt.mu.Lock()
+	delete(rt.flights, key)
+	rt.mu.Unlock()
+	close(f.done)
+
+	return resp, err
+}
+
+// lead sends the request of the flight upstream and reads the
+// body of the response to share it with the waiters.
+func (rt *roundTripper) lead(req *http.Request, policy *directors.CoalescePolicy, f *flight) (*http.Response, error) {
+	resp, err := rt.dispatch(req)
+	f.req = req
+	f.upstream = directors.GetRequestInfo(req).Upstream
+	if err != nil {
+		f.err = err
+		f.cancelled = req.Context().Err() != nil
+		return nil, err
+	}
+
+	if !shareable(resp, policy.MaxBodyBytes) {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, policy.MaxBodyBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		f.err = err
+		f.cancelled = req.Context().Err() != nil
+		return nil, err
+	}
+
+	if int64(len(body)) > policy.MaxBodyBytes {
+		// too large to be shared, the rest is streamed
+		resp.Body = &struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	shared := *resp
+	shared.Header = resp.Header.Clone()
+	f.resp, f.body = &shared, body
+
+	return f.response(req), nil
+}
+
+// wait waits for the response of the flight and returns a copy
+// of it. If the response can't be shared, the request is sent
+// upstream.
+func (rt *roundTripper) wait(req *http.Request, policy *directors.CoalescePolicy, f *flight) (*http.Response, error) {
+	start := time.Now()
+	select {
+	case <-f.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	switch {
+	case f.cancelled:
+		return rt.coalesce(req, policy)
+	case f.err == nil && (f.resp == nil || !sameVariant(f.req, req, f.resp.Header)):
+		return rt.dispatch(req)
+	}
+
+	info := directors.GetRequestInfo(req)
+	info.Coalesced = true
+	info.Upstream = f.upstream
+	info.UpstreamStart = start
+	info.UpstreamDuration = time.Since(start)
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.response(req), nil
+}
+
+// response returns a copy of the shared response for the request.
+func (f *flight) response(req *http.Request) *http.Response {
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+	resp.Request = req
+	if req.Method != "HEAD" {
+		resp.ContentLength = int64(len(f.body))
+	}
+	return &resp
+}
+
+// shareable reports whether the response can be handed to
+// other clients. Streams and bodies which are known to be
+// larger than maxBodyBytes are not buffered.
+func shareable(resp *http.Response, maxBodyBytes int64) bool {
+	cacheControl := strings.ToLower(strings.Join(resp.Header.Values("Cache-Control"), ","))
+	switch {
+	case resp.StatusCode < 200,
+		strings.Contains(cacheControl, "no-store"),
+		strings.Contains(cacheControl, "private"),
+		resp.Header.Get("Set-Cookie") != "",
+		resp.ContentLength > maxBodyBytes,
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		return false
+	}
+	return true
+}
+
+// sameVariant reports whether the response to a is the one to b,
+// by the request headers listed in its Vary header.
+func sameVariant(a, b *http.Request, header http.Header) bool {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return false
+			}
+			if strings.Join(a.Header.Values(name), ",") != strings.Join(b.Header.Values(name), ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+// Package compression implements a response modifier which compresses
+// upstream responses with gzip or deflate, as negotiated with the
+// Accept-Encoding header of the client.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultContentTypes are the compressed media types. Types ending
+// with "/" match all subtypes (e.g. "text/").
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/problem+json",
+	"application/javascript",
+	"application/xml",
+	"application/x-ndjson",
+	"image/svg+xml",
+}
+
+// Options configure the compression of responses.
+type Options struct {
+	// ContentTypes are the media types of responses
+	// which are compressed (default DefaultContentTypes).
+	ContentTypes []string
+
+	// MinSize is the Content-Length of the smallest response
+	// which is compressed (default 1024). Responses of unknown
+	// length are compressed.
+	MinSize int64
+
+	// Level is the compression level of gzip and deflate, from
+	// 1 (best speed) to 9 (best compression). 0 and invalid levels
+	// mean gzip.DefaultCompression.
+	Level int
+}
+
+// New returns a response modifier which compresses the responses
+// with an allowed content type, unless they are already encoded, or
+// their Cache-Control has no-transform. Vary: Accept-Encoding is added
+// to them whether they are compressed for the client or not. The body
+// is compressed while it's streamed to the client.
+func New(opts Options) func(resp *http.Response) error {
+	if len(opts.ContentTypes) == 0 {
+		opts.ContentTypes = DefaultContentTypes
+	}
+	if opts.MinSize <= 0 {
+		opts.MinSize = 1024
+	}
+	if opts.Level == 0 || opts.Level < gzip.HuffmanOnly || opts.Level > gzip.BestCompression {
+		opts.Level = gzip.DefaultCompression
+	}
+
+	c := &compressor{options: opts}
+	c.gzip.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, opts.Level)
+		return w
+	}
+	c.deflate.New = func() interface{} {
+		w, _ := zlib.NewWriterLevel(nil, opts.Level)
+		return w
+	}
+	return c.modify
+}
+
+type compressor struct {
+	options Options
+	gzip    sync.Pool // of *gzip.Writer
+	deflate sync.Pool // of *zlib.Writer
+}
+
+// encoder is implemented by gzip and zlib writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+func (c *compressor) modify(resp *http.Response) error {
+	if !c.compressible(resp) || resp.ContentLength >= 0 && resp.ContentLength < c.options.MinSize {
+		return nil
+	}
+
+	addVary(resp.Header, "Accept-Encoding")
+	if resp.Request.Method == "HEAD" {
+		return nil
+	}
+
+	encoding := negotiate(resp.Request.Header.Values("Accept-Encoding"))
+	pool := &c.gzip
+	switch encoding {
+	case "gzip":
+	case "deflate":
+		pool = &c.deflate
+	default:
+		return nil
+	}
+
+	enc := pool.Get().(encoder)
+	body := &compressedBody{src: resp.Body, enc: enc, pool: pool, chunk: make([]byte, 32<<10)}
+	enc.Reset(&body.buf)
+
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.Header.Set("Content-Encoding", encoding)
+
+	// the compressed representation is not byte-for-byte the same
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// compressible reports whether the response is eligible
+// for compression, regardless of the client.
+func (c *compressor) compressible(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified, resp.StatusCode == http.StatusPartialContent:
+		return false
+	case resp.Header.Get("Content-Encoding") != "" && !strings.EqualFold(resp.Header.Get("Content-Encoding"), "identity"),
+		resp.Header.Get("Content-Range") != "",
+		strings.Contains(strings.ToLower(strings.Join(resp.Header.Values("Cache-Control"), ",")), "no-transform"):
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.options.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if mediaType == allowed || strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate returns the preferred encoding of the client out of
+// gzip and deflate (RFC 9110 section 12.5.3), or "" if it accepts
+// neither of them.
+func negotiate(acceptEncoding []string) string {
+	qualities := map[string]float64{}
+	for _, value := range acceptEncoding {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "" {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+			qualities[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// addVary adds the header name to Vary, unless it's listed.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			listed = strings.TrimSpace(listed)
+			if listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// compressedBody compresses the body of the upstream response
+// while it's read. The compressed data is flushed after every
+// read from the upstream, so streams are not held back.
+type compressedBody struct {
+	src   io.ReadCloser
+	enc   encoder
+	pool  *sync.Pool
+	buf   bytes.Buffer
+	chunk []byte
+	eof   bool
+}
+
+func (b *compressedBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 && !b.eof {
+		n, err := b.src.Read(b.chunk)
+		if n > 0 {
+			b.enc.Write(b.chunk[:n])
+			b.enc.Flush()
+		}
+
+		switch {
+		case err == io.EOF:
+			b.enc.Close()
+			b.eof = true
+		case err != nil:
+			return 0, err
+		}
+	}
+
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *compressedBody) Close() error {
+	if b.enc != nil {
+		b.enc.Reset(nil)
+		b.pool.Put(b.enc)
+		b.enc = nil
+	}
+	return b.src.Close()
+}
@@ -0,0 +1,103 @@
+package compression
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var body = strings.Repeat(`{"name":"value"}`, 200)
+
+func response(acceptEncoding string, header http.Header) *http.Response {
+	req := httptest.NewRequest("GET", "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: -1,
+		Request:       req,
+	}
+}
+
+func TestCompress(t *testing.T) {
+	modify := New(Options{})
+
+	for encoding, reader := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	} {
+		resp := response(encoding, http.Header{"Etag": {`"v1"`}})
+		if err := modify(resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Header.Get("Content-Encoding") != encoding || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("Expected a %s response varying by Accept-Encoding, got %v", encoding, resp.Header)
+		}
+		if resp.Header.Get("Etag") != `W/"v1"` {
+			t.Fatalf("Expected a weak ETag, got %s", resp.Header.Get("Etag"))
+		}
+
+		r, err := reader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, _ := ioutil.ReadAll(r)
+		resp.Body.Close()
+		if string(decompressed) != body {
+			t.Fatalf("Expected the body to be decompressed, got %q", decompressed)
+		}
+	}
+}
+
+func TestNotCompressed(t *testing.T) {
+	modify := New(Options{MinSize: 100})
+
+	for name, resp := range map[string]*http.Response{
+		"not accepted":     response("gzip;q=0, identity", http.Header{}),
+		"already encoded":  response("gzip", http.Header{"Content-Encoding": {"br"}}),
+		"content type":     response("gzip", http.Header{"Content-Type": {"image/png"}}),
+		"no-transform":     response("gzip", http.Header{"Cache-Control": {"no-transform"}}),
+		"smaller than min": func() *http.Response { resp := response("gzip", http.Header{}); resp.ContentLength = 10; return resp }(),
+	} {
+		modify(resp)
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "br" {
+			t.Fatalf("[%s] Expected the response not to be compressed", name)
+		}
+	}
+
+	// the response depends on Accept-Encoding
+	resp := response("", http.Header{"Vary": {"Origin"}})
+	modify(resp)
+	if vary := resp.Header.Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Fatalf("Expected Vary: Accept-Encoding, got %v", vary)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"":                        "",
+		"gzip, deflate, br":       "gzip",
+		"deflate":                 "deflate",
+		"gzip;q=0.5, deflate;q=1": "deflate",
+		"*":                       "gzip",
+		"*;q=0.1, gzip;q=0":       "deflate",
+		"identity":                "",
+	} {
+		if encoding := negotiate([]string{acceptEncoding}); encoding != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, acceptEncoding, encoding)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package config
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/accesslog"
+	"github.com/zgiber/proxy/auth"
+	"github.com/zgiber/proxy/breaker"
+	"github.com/zgiber/proxy/cache"
+	"github.com/zgiber/proxy/capture"
+	"github.com/zgiber/proxy/compression"
+	"github.com/zgiber/proxy/directors"
+	"github.com/zgiber/proxy/metrics"
+	"github.com/zgiber/proxy/tracing"
+)
+
+// Build returns a ReverseProxy with the directors described
+// by the configuration, set up the same way as by NewManager
+// but without a configuration file to reload.
+func Build(cfg *Config) (*proxy.ReverseProxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	m, err := newManager("", cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.record(change{author: "build", reason: "build"})
+	return m.Proxy(), nil
+}
+
+// buildDirector chains the global directors and the router.
+// The router is returned as well so routes can be changed
+// without rebuilding the chain.
+func buildDirector(cfg *Config, upstreams map[string]*directors.LoadBalancer) (func(*http.Request), *directors.Router) {
+	chain := []func(*http.Request){}
+
+	// first, so the span covers the other directors
+	if cfg.Tracing != nil {
+		chain = append(chain, tracing.Director)
+	}
+
+	if cfg.RateLimit != nil {
+		chain = append(chain, newRateLimiter(cfg.RateLimit))
+	}
+
+	if cfg.Correlation.Enabled {
+		// validated with the configuration
+		correlation, _ := cfg.Correlation.director()
+		chain = append(chain, correlation)
+	}
+
+	if cfg.Headers != nil {
+		// validated with the configuration
+		headers, _ := cfg.Headers.director()
+		chain = append(chain, headers)
+	}
+
+	targets := map[string]func(*http.Request){}
+	for _, route := range cfg.Routes {
+		targets[route.Pattern] = buildRoute(route, cfg.Auth, upstreams)
+	}
+	router := directors.NewDynamicRouter(targets)
+	chain = append(chain, router.Direct)
+
+	return directors.Chain(chain...), router
+}
+
+// buildRoute returns the director for a single route.
+// Routes with an upstream use its load balancer.
+func buildRoute(route Route, authConfig Auth, upstreams map[string]*directors.LoadBalancer) func(*http.Request) {
+	chain := []func(*http.Request){}
+
+	if route.AccessLog != nil && !*route.AccessLog {
+		chain = append(chain, directors.DisableAccessLog)
+	}
+
+	// before auth, preflight requests don't carry credentials
+	if c := route.CORS; c != nil {
+		// validated with the configuration
+		cors, _ := directors.NewCORS(directors.CORSPolicy{
+			AllowedOrigins:   c.AllowedOrigins,
+			AllowedMethods:   c.AllowedMethods,
+			AllowedHeaders:   c.AllowedHeaders,
+			ExposedHeaders:   c.ExposedHeaders,
+			AllowCredentials: c.AllowCredentials,
+			MaxAge:           c.MaxAge.Duration,
+		})
+		chain = append(chain, cors)
+	}
+
+	if route.Auth == AuthJWT {
+		chain = append(chain, directors.NewJWTAuthWithKey(authConfig.JWTKey))
+	}
+
+	if route.RateLimit != nil {
+		chain = append(chain, newRateLimiter(route.RateLimit))
+	}
+
+	if t := route.Timeouts; t != nil {
+		chain = append(chain, directors.NewTimeouts(directors.Timeouts{
+			Connect:        t.Connect.Duration,
+			ResponseHeader: t.ResponseHeader.Duration,
+			Total:          t.Total.Duration,
+			DeadlineHeader: t.DeadlineHeader,
+		}))
+	}
+
+	if route.Retry != nil {
+		chain = append(chain, newRetry(route.Retry))
+	}
+
+	if route.Hedge != nil {
+		chain = append(chain, newHedge(route.Hedge))
+	}
+
+	if c := route.Coalesce; c != nil {
+		chain = append(chain, directors.NewCoalesce(directors.CoalescePolicy{
+			Vary:         c.Vary,
+			MaxBodyBytes: c.MaxBodyBytes,
+		}))
+	}
+
+	if route.Headers != nil {
+		// validated with the configuration
+		headers, _ := route.Headers.director()
+		chain = append(chain, headers)
+	}
+
+	if route.Upstream != "" {
+		chain = append(chain, upstreams[route.Upstream].Direct)
+	} else {
+		chain = append(chain, directors.NewSingleHost(route.Target))
+	}
+	return directors.Chain(chain...)
+}
+
+// buildUpstream returns the load balancer of an upstream pool and
+// starts its health checks. It must be closed when it's replaced.
+// Ejections of outliers are recorded in m if it's not nil.
+func buildUpstream(name string, upstream Upstream, m *metrics.Metrics) *directors.LoadBalancer {
+	targets := make([]*directors.Target, 0, len(upstream.Targets))
+	for _, t := range upstream.Targets {
+		// validated with the configuration
+		target, _ := directors.NewTarget(t.URL, t.Weight)
+		targets = append(targets, target)
+	}
+
+	policy, _ := upstream.policy()
+	lb := directors.NewLoadBalancer(targets, policy)
+
+	if hc := upstream.HealthCheck; hc != nil {
+		lb.CheckHealth(directors.HealthCheck{
+			Path:               hc.Path,
+			ExpectedStatus:     hc.ExpectedStatus,
+			Interval:           hc.Interval.Duration,
+			Timeout:            hc.Timeout.Duration,
+			HealthyThreshold:   hc.HealthyThreshold,
+			UnhealthyThreshold: hc.UnhealthyThreshold,
+		})
+	}
+
+	if od := upstream.OutlierDetection; od != nil {
+		outliers := directors.OutlierDetection{
+			Consecutive5xx:     od.Consecutive5xx,
+			ConsecutiveErrors:  od.ConsecutiveErrors,
+			LatencyFactor:      od.LatencyFactor,
+			BaseEjectionTime:   od.BaseEjectionTime.Duration,
+			MaxEjectionTime:    od.MaxEjectionTime.Duration,
+			MaxEjectionPercent: od.MaxEjectionPercent,
+		}
+		if m != nil {
+			outliers.OnEject = func(target *directors.Target, reason string) {
+				m.ObserveEjection(name, target.URL.Host, reason)
+			}
+		}
+		lb.DetectOutliers(outliers)
+	}
+	return lb
+}
+
+// director returns the correlation ID director.
+func (c *Correlation) director() (func(*http.Request), error) {
+	options := directors.CorrelationOptions{
+		Header:        c.Header,
+		TrustIncoming: c.TrustIncoming,
+		MaxLength:     c.MaxLength,
+		Format:        c.Format,
+		Echo:          c.Echo,
+	}
+
+	if c.Pattern != "" {
+		pattern, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		options.Pattern = pattern
+	}
+
+	return directors.NewCorrelationWithOptions(options)
+}
+
+func newRateLimiter(rl *RateLimit) func(*http.Request) {
+	return directors.NewRateLimiter(rl.Delay.Duration, rl.Timeout.Duration, rl.Burst)
+}
+
+// buildAdminAuth returns the authenticators and endpoint roles
+// of the configuration API.
+func buildAdminAuth(cfg *Config) ([]auth.Authenticator, map[string]auth.Role) {
+	adminAuth := cfg.Admin.Auth
+	if adminAuth == nil {
+		return nil, nil
+	}
+
+	authenticators := []auth.Authenticator{}
+
+	if len(adminAuth.ClientCerts) > 0 {
+		identities := map[string]auth.Identity{}
+		for _, cert := range adminAuth.ClientCerts {
+			identities[cert.CommonName] = auth.Identity{Name: cert.CommonName, Role: cert.Role}
+		}
+		authenticators = append(authenticators, auth.NewClientCertAuthenticator(identities))
+	}
+
+	if len(adminAuth.Tokens) > 0 {
+		tokens := map[string]auth.Identity{}
+		for _, token := range adminAuth.Tokens {
+			tokens[token.Token] = auth.Identity{Name: token.Name, Role: token.Role}
+		}
+		authenticators = append(authenticators, auth.NewBearerTokenAuthenticator(tokens))
+	}
+
+	if adminAuth.JWT != nil {
+		roleClaim := adminAuth.JWT.RoleClaim
+		if roleClaim == "" {
+			roleClaim = "role"
+		}
+		authenticators = append(authenticators, auth.NewJWTAuthenticatorWithKey(roleClaim, adminAuth.JWT.Key))
+	}
+
+	return authenticators, adminAuth.Endpoints
+}
+
+// openAccessLog returns the access logger and the file it writes
+// to (nil for stdout). Both are nil if access logging is disabled.
+func openAccessLog(al *AccessLog) (*accesslog.Logger, io.Closer, error) {
+	if al == nil {
+		return nil, nil, nil
+	}
+
+	if al.Output == "stdout" {
+		return accesslog.New(os.Stdout), nil, nil
+	}
+
+	file, err := accesslog.NewRotatingFile(al.Output, int64(al.MaxSizeMB)<<20, al.MaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return accesslog.New(file), file, nil
+}
+
+// newTracer returns the span exporter, or nil if tracing is disabled.
+func newTracer(t *Tracing) *tracing.Tracer {
+	if t == nil {
+		return nil
+	}
+
+	return tracing.NewTracer(tracing.Options{
+		Collector:   t.Collector,
+		ServiceName: t.ServiceName,
+	})
+}
+
+// newRetry returns the director applying the retry policy of a route.
+func newRetry(r *Retry) func(*http.Request) {
+	percent, minPerSecond := r.BudgetPercent, r.MinRetriesPerSecond
+	if percent == 0 {
+		percent = 20
+	}
+	if minPerSecond == 0 {
+		minPerSecond = 3
+	}
+
+	return directors.NewRetry(directors.RetryPolicy{
+		MaxRetries:   r.MaxRetries,
+		StatusCodes:  r.StatusCodes,
+		BaseBackoff:  r.BaseBackoff.Duration,
+		MaxBackoff:   r.MaxBackoff.Duration,
+		MaxBodyBytes: r.MaxBodyBytes,
+		Budget:       directors.NewRetryBudget(percent, minPerSecond),
+	})
+}
+
+// newHedge returns the director applying the hedge policy of a route.
+func newHedge(h *Hedge) func(*http.Request) {
+	percent := h.MaxExtraPercent
+	if percent == 0 {
+		percent = 10
+	}
+
+	return directors.NewHedge(directors.HedgePolicy{
+		Percentile: h.Percentile,
+		MinDelay:   h.MinDelay.Duration,
+		MaxDelay:   h.MaxDelay.Duration,
+		Budget:     directors.NewRetryBudget(percent, 0),
+	})
+}
+
+// newCircuitBreakers returns the circuit breakers of the upstream
+// hosts, or nil if they are disabled.
+func newCircuitBreakers(cb *CircuitBreaker) *breaker.Set {
+	if cb == nil {
+		return nil
+	}
+
+	return breaker.NewSet(breaker.Settings{
+		ConsecutiveFailures: cb.ConsecutiveFailures,
+		ErrorRate:           cb.ErrorRate,
+		MinRequests:         cb.MinRequests,
+		Window:              cb.Window.Duration,
+		OpenTimeout:         cb.OpenTimeout.Duration,
+		HalfOpenProbes:      cb.HalfOpenProbes,
+	})
+}
+
+// newCache returns the response cache, or nil if it's disabled.
+func newCache(c *Cache) *cache.Cache {
+	if c == nil {
+		return nil
+	}
+
+	maxEntries, maxBytes := c.MaxEntries, c.MaxBytes
+	if maxEntries == 0 {
+		maxEntries = 10000
+	}
+	if maxBytes == 0 {
+		maxBytes = 64 << 20
+	}
+
+	return cache.New(cache.Options{
+		Store:         cache.NewLRU(maxEntries, maxBytes),
+		MaxEntryBytes: c.MaxEntryBytes,
+	})
+}
+
+// newCompression returns the response modifier compressing
+// the responses, or nil if compression is disabled.
+func newCompression(c *Compression) func(*http.Response) error {
+	if c == nil {
+		return nil
+	}
+
+	return compression.New(compression.Options{
+		ContentTypes: c.ContentTypes,
+		MinSize:      c.MinSize,
+		Level:        c.Level,
+	})
+}
+
+// OpenCapture opens the capture file and returns a Recorder
+// writing to it. It returns nil if capturing is disabled.
+func OpenCapture(c *Capture) (*capture.Recorder, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	// the exchanges may contain personal data
+	file, err := os.OpenFile(c.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBodyBytes := c.MaxBodyBytes
+	if maxBodyBytes == 0 {
+		maxBodyBytes = 64 << 10
+	}
+
+	return capture.NewRecorder(file, capture.Options{
+		MaxBodySize:   maxBodyBytes,
+		RedactHeaders: append(append([]string{}, capture.DefaultRedactHeaders...), c.RedactHeaders...),
+	}), nil
+}
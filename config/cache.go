@@ -0,0 +1,48 @@
+package config
+
+import (
+	"net/http"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/directors"
+)
+
+// serveCache is the handler of the cache API:
+//
+//	GET    /cache                returns the number of entries by route
+//	DELETE /cache?route=/api/*   purges the entries of a route
+//	DELETE /cache?key={key}      purges the entry with a cache.Key
+//	DELETE /cache                purges all entries
+func (m *Manager) serveCache(rw http.ResponseWriter, req *http.Request) {
+	c := m.current().cache
+	if c == nil {
+		proxy.WriteError(rw, req, directors.ErrNotFound("cache is disabled"))
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"entries": c.Entries(),
+		})
+
+	case "DELETE":
+		query := req.URL.Query()
+
+		var purged int
+		switch {
+		case query.Get("route") != "":
+			purged = c.PurgeRoute(query.Get("route"))
+		case query.Get("key") != "":
+			purged = c.Purge(query.Get("key"))
+		default:
+			purged = c.PurgeAll()
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"purged": purged,
+		})
+
+	default:
+		methodNotAllowed(rw, req, "GET, DELETE")
+	}
+}
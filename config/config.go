@@ -0,0 +1,817 @@
+// Package config describes the proxy in a declarative configuration
+// file (YAML or JSON) and builds a fully wired proxy from it.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zgiber/proxy/auth"
+	"github.com/zgiber/proxy/directors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the root of the configuration file.
+type Config struct {
+	Listen      Listen              `json:"listen" yaml:"listen"`
+	Correlation Correlation         `json:"correlation" yaml:"correlation"`
+	RateLimit   *RateLimit          `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	Auth        Auth                `json:"auth" yaml:"auth"`
+	Admin       Admin               `json:"admin" yaml:"admin"`
+	AccessLog   *AccessLog          `json:"access_log,omitempty" yaml:"access_log,omitempty"`
+	Capture     *Capture            `json:"capture,omitempty" yaml:"capture,omitempty"`
+	Tracing     *Tracing            `json:"tracing,omitempty" yaml:"tracing,omitempty"`
+	Upstreams   map[string]Upstream `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+	Routes      []Route             `json:"routes" yaml:"routes"`
+
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+	Cache          *Cache          `json:"cache,omitempty" yaml:"cache,omitempty"`
+	Compression    *Compression    `json:"compression,omitempty" yaml:"compression,omitempty"`
+	Headers        *Headers        `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// Listen holds the addresses of the proxy and the configuration API.
+type Listen struct {
+	Proxy string `json:"proxy" yaml:"proxy"`
+	Admin string `json:"admin,omitempty" yaml:"admin,omitempty"`
+	TLS   *TLS   `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// TLS holds the certificate and key for serving https.
+type TLS struct {
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+}
+
+// Correlation configures the correlation ID director. The ID is
+// sent in Header (default X-Correlation-ID), the client's ID is kept
+// if TrustIncoming is set and it's valid: not longer than MaxLength
+// (default 128) and matching Pattern. Generated IDs are in Format:
+// "random" (default), "uuidv4", "uuidv7" or "ulid". Echo returns the
+// ID to the client in the same header.
+type Correlation struct {
+	Enabled       bool   `json:"enabled" yaml:"enabled"`
+	Header        string `json:"header,omitempty" yaml:"header,omitempty"`
+	TrustIncoming bool   `json:"trust_incoming,omitempty" yaml:"trust_incoming,omitempty"`
+	MaxLength     int    `json:"max_length,omitempty" yaml:"max_length,omitempty"`
+	Pattern       string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Format        string `json:"format,omitempty" yaml:"format,omitempty"`
+	Echo          bool   `json:"echo,omitempty" yaml:"echo,omitempty"`
+}
+
+// RateLimit configures a rate limiter director.
+// Delay is the minimum time between calls, Timeout is the
+// time a client is tracked and Burst is the number of burst calls.
+type RateLimit struct {
+	Delay   Duration `json:"delay" yaml:"delay"`
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	Burst   int      `json:"burst" yaml:"burst"`
+}
+
+// Auth configures the JWT verification used by routes
+// with auth set to "jwt".
+type Auth struct {
+	JWTKey string `json:"jwt_key,omitempty" yaml:"jwt_key,omitempty"`
+}
+
+// AccessLog configures the JSONL access log. Output is "stdout" or
+// the path of a file, which is rotated when it reaches MaxSizeMB.
+type AccessLog struct {
+	Output     string `json:"output" yaml:"output"`
+	MaxSizeMB  int    `json:"max_size_mb,omitempty" yaml:"max_size_mb,omitempty"`
+	MaxBackups int    `json:"max_backups,omitempty" yaml:"max_backups,omitempty"`
+}
+
+// Capture records full request/response pairs to the Output file,
+// which can be replayed later. Bodies are recorded up to MaxBodyBytes
+// (default 64KB). Values of Authorization, Proxy-Authorization, Cookie,
+// Set-Cookie and RedactHeaders are not recorded. The file is created
+// readable by the owner only. Changes are applied after restart.
+type Capture struct {
+	Output        string   `json:"output" yaml:"output"`
+	MaxBodyBytes  int64    `json:"max_body_bytes,omitempty" yaml:"max_body_bytes,omitempty"`
+	RedactHeaders []string `json:"redact_headers,omitempty" yaml:"redact_headers,omitempty"`
+}
+
+// Tracing propagates W3C trace context headers and exports the
+// spans of proxied requests to the OTLP/HTTP Collector endpoint
+// (e.g. http://localhost:4318/v1/traces).
+type Tracing struct {
+	Collector   string `json:"collector" yaml:"collector"`
+	ServiceName string `json:"service_name,omitempty" yaml:"service_name,omitempty"`
+}
+
+// CircuitBreaker guards every upstream host with a circuit breaker.
+// It opens after ConsecutiveFailures (default 5) failed requests in
+// a row (connection errors or 5xx responses), or when more than
+// ErrorRate of at least MinRequests (default 20) requests fail in
+// a Window (default 10s). Requests fail fast with 503 while it's
+// open, after OpenTimeout (default 30s) HalfOpenProbes (default 1)
+// requests are let through, it closes if all of them succeed.
+type CircuitBreaker struct {
+	ConsecutiveFailures int      `json:"consecutive_failures,omitempty" yaml:"consecutive_failures,omitempty"`
+	ErrorRate           float64  `json:"error_rate,omitempty" yaml:"error_rate,omitempty"`
+	MinRequests         int      `json:"min_requests,omitempty" yaml:"min_requests,omitempty"`
+	Window              Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	OpenTimeout         Duration `json:"open_timeout,omitempty" yaml:"open_timeout,omitempty"`
+	HalfOpenProbes      int      `json:"half_open_probes,omitempty" yaml:"half_open_probes,omitempty"`
+}
+
+// Cache stores the responses of the upstreams in memory according to
+// their Cache-Control headers, up to MaxEntries (default 10000) and
+// MaxBytes (default 64MiB). Bodies larger than MaxEntryBytes (default
+// 1MiB) are not stored. Entries can be purged on "/cache".
+type Cache struct {
+	MaxEntries    int   `json:"max_entries,omitempty" yaml:"max_entries,omitempty"`
+	MaxBytes      int64 `json:"max_bytes,omitempty" yaml:"max_bytes,omitempty"`
+	MaxEntryBytes int64 `json:"max_entry_bytes,omitempty" yaml:"max_entry_bytes,omitempty"`
+}
+
+// Compression compresses the responses to clients accepting gzip or
+// deflate if their Content-Type is in ContentTypes (default text and
+// JSON types, "text/" matches all text types) and they are at least
+// MinSize (default 1024) bytes. Already encoded responses are left
+// alone. Level is the compression level from 1 to 9, 0 (the default)
+// uses the default level of the compressors.
+type Compression struct {
+	ContentTypes []string `json:"content_types,omitempty" yaml:"content_types,omitempty"`
+	MinSize      int64    `json:"min_size,omitempty" yaml:"min_size,omitempty"`
+	Level        int      `json:"level,omitempty" yaml:"level,omitempty"`
+}
+
+// Admin configures the configuration API served on listen.admin.
+// Auth is required, unless Insecure explicitly allows serving the
+// API without authentication.
+type Admin struct {
+	TLS      *AdminTLS  `json:"tls,omitempty" yaml:"tls,omitempty"`
+	Auth     *AdminAuth `json:"auth,omitempty" yaml:"auth,omitempty"`
+	Insecure bool       `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+}
+
+// AdminTLS holds the certificate and key for serving the configuration
+// API on https. Client certificates are verified with the CA
+// certificates in ClientCAFile.
+type AdminTLS struct {
+	CertFile     string `json:"cert_file" yaml:"cert_file"`
+	KeyFile      string `json:"key_file" yaml:"key_file"`
+	ClientCAFile string `json:"client_ca_file,omitempty" yaml:"client_ca_file,omitempty"`
+}
+
+// AdminAuth configures how clients of the configuration API are
+// authenticated. By default reads require read-only and changes
+// require read-write role. Endpoints raises the role required for
+// paths under the given prefix.
+type AdminAuth struct {
+	Tokens      []TokenIdentity      `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+	JWT         *AdminJWT            `json:"jwt,omitempty" yaml:"jwt,omitempty"`
+	ClientCerts []ClientCertIdentity `json:"client_certs,omitempty" yaml:"client_certs,omitempty"`
+	Endpoints   map[string]auth.Role `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+}
+
+// AdminJWT enables JWTs signed with Key, which must differ from
+// auth.jwt_key so tokens of the routes are not accepted by the
+// configuration API. The role of the client is read from RoleClaim
+// (default "role").
+type AdminJWT struct {
+	Key       string `json:"key" yaml:"key"`
+	RoleClaim string `json:"role_claim,omitempty" yaml:"role_claim,omitempty"`
+}
+
+// TokenIdentity is a static bearer token of a client.
+type TokenIdentity struct {
+	Token string    `json:"token" yaml:"token"`
+	Name  string    `json:"name" yaml:"name"`
+	Role  auth.Role `json:"role" yaml:"role"`
+}
+
+// ClientCertIdentity maps the common name of a client certificate to a role.
+type ClientCertIdentity struct {
+	CommonName string    `json:"common_name" yaml:"common_name"`
+	Role       auth.Role `json:"role" yaml:"role"`
+}
+
+// Upstream is a pool of targets which can be shared by routes.
+// Requests are distributed by the load balancing Policy:
+// "round_robin" (default), "weighted_round_robin", "random",
+// "least_outstanding", "power_of_two_choices" or "consistent_hash".
+// Consistent hashing sends requests with the same HashKey to the
+// same target, the key is "path:<variable>", "header:<name>",
+// "cookie:<name>" or "client_ip".
+type Upstream struct {
+	Targets     []UpstreamTarget `json:"targets" yaml:"targets"`
+	Policy      string           `json:"policy,omitempty" yaml:"policy,omitempty"`
+	HashKey     string           `json:"hash_key,omitempty" yaml:"hash_key,omitempty"`
+	HealthCheck *HealthCheck     `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+
+	OutlierDetection *OutlierDetection `json:"outlier_detection,omitempty" yaml:"outlier_detection,omitempty"`
+}
+
+// HealthCheck configures active health checks of the targets of
+// an upstream. Path is requested on every target at Interval
+// (default 10s), a check fails if it takes longer than Timeout
+// (default 2s) or the status is not ExpectedStatus (default any
+// 2xx). Targets are removed from load balancing after
+// UnhealthyThreshold (default 3) failed checks in a row and added
+// back after HealthyThreshold (default 2) successful checks.
+type HealthCheck struct {
+	Path               string   `json:"path" yaml:"path"`
+	ExpectedStatus     int      `json:"expected_status,omitempty" yaml:"expected_status,omitempty"`
+	Interval           Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty" yaml:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty" yaml:"unhealthy_threshold,omitempty"`
+}
+
+// OutlierDetection ejects targets of an upstream based on their
+// responses: after Consecutive5xx (default 5) responses with 5xx
+// status or ConsecutiveErrors (default 5) connection errors in a
+// row, or when their average latency is more than LatencyFactor
+// times the average of the other targets (disabled by default).
+// Targets are ejected for BaseEjectionTime (default 30s), doubled
+// for every ejection in a row up to MaxEjectionTime (default 5m).
+// At most MaxEjectionPercent (default 50, rounded down) of the targets
+// are ejected at the same time.
+type OutlierDetection struct {
+	Consecutive5xx     int      `json:"consecutive_5xx,omitempty" yaml:"consecutive_5xx,omitempty"`
+	ConsecutiveErrors  int      `json:"consecutive_errors,omitempty" yaml:"consecutive_errors,omitempty"`
+	LatencyFactor      float64  `json:"latency_factor,omitempty" yaml:"latency_factor,omitempty"`
+	BaseEjectionTime   Duration `json:"base_ejection_time,omitempty" yaml:"base_ejection_time,omitempty"`
+	MaxEjectionTime    Duration `json:"max_ejection_time,omitempty" yaml:"max_ejection_time,omitempty"`
+	MaxEjectionPercent int      `json:"max_ejection_percent,omitempty" yaml:"max_ejection_percent,omitempty"`
+}
+
+// UpstreamTarget is a target of an upstream pool. Its URL is
+// applied the same way as the target of a route.
+type UpstreamTarget struct {
+	URL    string `json:"url" yaml:"url"`
+	Weight int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// Route maps a route definition of the router (e.g. "/api/:user_id/*")
+// to a single upstream target or to an upstream pool by name.
+type Route struct {
+	Pattern   string     `json:"pattern" yaml:"pattern"`
+	Target    string     `json:"target,omitempty" yaml:"target,omitempty"`
+	Upstream  string     `json:"upstream,omitempty" yaml:"upstream,omitempty"`
+	Auth      string     `json:"auth,omitempty" yaml:"auth,omitempty"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	AccessLog *bool      `json:"access_log,omitempty" yaml:"access_log,omitempty"`
+	Timeouts  *Timeouts  `json:"timeouts,omitempty" yaml:"timeouts,omitempty"`
+	Retry     *Retry     `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Hedge     *Hedge     `json:"hedge,omitempty" yaml:"hedge,omitempty"`
+	Coalesce  *Coalesce  `json:"coalesce,omitempty" yaml:"coalesce,omitempty"`
+	CORS      *CORS      `json:"cors,omitempty" yaml:"cors,omitempty"`
+	Headers   *Headers   `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// Timeouts of the requests of a route: Connect limits new connections
+// to the upstream, ResponseHeader the wait for the response headers of
+// every attempt and Total the whole request. Requests which time out
+// are answered with 504. The remaining time is sent to the upstream in
+// DeadlineHeader if it's set (e.g. "X-Request-Deadline" in milliseconds
+// or "grpc-timeout").
+type Timeouts struct {
+	Connect        Duration `json:"connect,omitempty" yaml:"connect,omitempty"`
+	ResponseHeader Duration `json:"response_header,omitempty" yaml:"response_header,omitempty"`
+	Total          Duration `json:"total,omitempty" yaml:"total,omitempty"`
+	DeadlineHeader string   `json:"deadline_header,omitempty" yaml:"deadline_header,omitempty"`
+}
+
+// Retry resends the requests of a route on connection errors and on
+// StatusCodes, up to MaxRetries (default 2) times. Only requests with
+// idempotent methods or an Idempotency-Key header are retried, with a
+// random back-off up to BaseBackoff (default 25ms) doubled for every
+// retry and capped at MaxBackoff (default 250ms). Bodies up to
+// MaxBodyBytes (default 64KiB) are buffered to be resent, requests
+// with larger bodies are not retried. Retries are limited to
+// BudgetPercent (default 20) of the requests of the route in 10s,
+// plus MinRetriesPerSecond (default 3).
+type Retry struct {
+	MaxRetries          int      `json:"max_retries,omitempty" yaml:"max_retries,omitempty"`
+	StatusCodes         []int    `json:"status_codes,omitempty" yaml:"status_codes,omitempty"`
+	BaseBackoff         Duration `json:"base_backoff,omitempty" yaml:"base_backoff,omitempty"`
+	MaxBackoff          Duration `json:"max_backoff,omitempty" yaml:"max_backoff,omitempty"`
+	MaxBodyBytes        int64    `json:"max_body_bytes,omitempty" yaml:"max_body_bytes,omitempty"`
+	BudgetPercent       int      `json:"budget_percent,omitempty" yaml:"budget_percent,omitempty"`
+	MinRetriesPerSecond int      `json:"min_retries_per_second,omitempty" yaml:"min_retries_per_second,omitempty"`
+}
+
+// Route authentication methods.
+const (
+	AuthNone = "none"
+	AuthJWT  = "jwt"
+)
+
+// Duration is a time.Duration which is encoded as a string
+// (e.g. "100ms") in configuration files.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) parse(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Load reads and validates the configuration file at path.
+// Files with .json extension are decoded as JSON, anything
+// else as YAML.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, formatOf(path))
+}
+
+// formatOf returns the format of the configuration file at path.
+func formatOf(path string) string {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return "json"
+	}
+	return "yaml"
+}
+
+// Parse decodes a configuration in the given format ("json" or "yaml")
+// and validates it.
+func Parse(data []byte, format string) (*Config, error) {
+	cfg := &Config{}
+
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, cfg)
+	case "yaml":
+		err = yaml.Unmarshal(data, cfg)
+	default:
+		err = fmt.Errorf("unknown config format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration for errors which would
+// prevent building a proxy from it.
+func (cfg *Config) Validate() error {
+	if cfg.Listen.Proxy == "" {
+		return errors.New("listen.proxy is required")
+	}
+
+	if cfg.Listen.TLS != nil && (cfg.Listen.TLS.CertFile == "" || cfg.Listen.TLS.KeyFile == "") {
+		return errors.New("listen.tls requires cert_file and key_file")
+	}
+
+	if cfg.Correlation.Enabled {
+		if _, err := cfg.Correlation.director(); err != nil {
+			return fmt.Errorf("correlation: %v", err)
+		}
+	}
+
+	if err := cfg.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+
+	if cfg.AccessLog != nil && cfg.AccessLog.Output == "" {
+		return errors.New("access_log: output is required")
+	}
+
+	if cfg.Capture != nil && cfg.Capture.Output == "" {
+		return errors.New("capture: output is required")
+	}
+
+	if cfg.Tracing != nil {
+		if err := validateTarget(cfg.Tracing.Collector); err != nil {
+			return fmt.Errorf("tracing: collector: %v", err)
+		}
+	}
+
+	if cb := cfg.CircuitBreaker; cb != nil && (cb.ErrorRate < 0 || cb.ErrorRate >= 1) {
+		return errors.New("circuit_breaker: error_rate must be between 0 and 1")
+	}
+
+	if cfg.Headers != nil {
+		if _, err := cfg.Headers.director(); err != nil {
+			return fmt.Errorf("headers: %v", err)
+		}
+		if cfg.Headers.usesVariable("path.") || cfg.Headers.usesVariable("jwt.") {
+			return errors.New("headers: ${path.*} and ${jwt.*} are only allowed in the headers of routes")
+		}
+	}
+
+	if c := cfg.Compression; c != nil && (c.Level < 0 || c.Level > 9) {
+		return errors.New("compression: level must be between 0 (default) and 9")
+	}
+
+	if err := cfg.validateAdmin(); err != nil {
+		return fmt.Errorf("admin: %v", err)
+	}
+
+	for name, upstream := range cfg.Upstreams {
+		if err := upstream.validate(); err != nil {
+			return fmt.Errorf("upstreams.%s: %v", name, err)
+		}
+	}
+
+	patterns := map[string]bool{}
+	for i, route := range cfg.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %v", i, err)
+		}
+
+		if _, ok := cfg.Upstreams[route.Upstream]; route.Upstream != "" && !ok {
+			return fmt.Errorf("routes[%d]: unknown upstream %q", i, route.Upstream)
+		}
+
+		if patterns[route.Pattern] {
+			return fmt.Errorf("routes[%d]: duplicate pattern %q", i, route.Pattern)
+		}
+		patterns[route.Pattern] = true
+
+		if route.Auth == AuthJWT && cfg.Auth.JWTKey == "" {
+			return fmt.Errorf("routes[%d]: auth.jwt_key is required for jwt auth", i)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the route's pattern, target and options.
+func (route *Route) Validate() error {
+	if err := directors.ValidateRoute(route.Pattern); err != nil {
+		return err
+	}
+
+	switch {
+	case route.Target != "" && route.Upstream != "":
+		return errors.New("target and upstream are mutually exclusive")
+	case route.Upstream == "":
+		if err := validateTarget(route.Target); err != nil {
+			return err
+		}
+	}
+
+	switch route.Auth {
+	case "", AuthNone, AuthJWT:
+	default:
+		return fmt.Errorf("unknown auth %q", route.Auth)
+	}
+
+	if err := route.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+
+	if err := route.Retry.validate(); err != nil {
+		return fmt.Errorf("retry: %v", err)
+	}
+
+	if h := route.Hedge; h != nil {
+		switch {
+		case route.Upstream == "":
+			return errors.New("hedge requires an upstream")
+		case h.Percentile < 0 || h.Percentile > 100:
+			return errors.New("hedge: percentile must be between 0 and 100")
+		case h.MaxExtraPercent < 0 || h.MaxExtraPercent > 100:
+			return errors.New("hedge: max_extra_percent must be between 0 and 100")
+		}
+	}
+
+	if route.Headers != nil {
+		if _, err := route.Headers.director(); err != nil {
+			return fmt.Errorf("headers: %v", err)
+		}
+	}
+
+	if c := route.CORS; c != nil {
+		if len(c.AllowedOrigins) == 0 {
+			return errors.New("cors: allowed_origins is required")
+		}
+		for _, origin := range c.AllowedOrigins {
+			// any origin could read the responses of the users
+			if origin == "*" && c.AllowCredentials {
+				return errors.New(`cors: allowed_origins "*" is not allowed with allow_credentials`)
+			}
+		}
+	}
+
+	if c := route.Coalesce; c != nil && c.MaxBodyBytes < 0 {
+		return errors.New("coalesce: max_body_bytes must not be negative")
+	}
+
+	return nil
+}
+
+func (cfg *Config) validateAdmin() error {
+	admin := cfg.Admin
+
+	if admin.TLS != nil && (admin.TLS.CertFile == "" || admin.TLS.KeyFile == "") {
+		return errors.New("tls requires cert_file and key_file")
+	}
+
+	if admin.Auth == nil {
+		if cfg.Listen.Admin != "" && !admin.Insecure {
+			return errors.New("auth is required, set insecure to serve the configuration API without authentication")
+		}
+		return nil
+	}
+
+	if len(admin.Auth.Tokens) == 0 && admin.Auth.JWT == nil && len(admin.Auth.ClientCerts) == 0 {
+		return errors.New("auth requires tokens, jwt or client_certs")
+	}
+
+	for i, token := range admin.Auth.Tokens {
+		if token.Token == "" {
+			return fmt.Errorf("tokens[%d]: token is required", i)
+		}
+		if !token.Role.Valid() {
+			return fmt.Errorf("tokens[%d]: invalid role %q", i, token.Role)
+		}
+	}
+
+	if jwt := admin.Auth.JWT; jwt != nil {
+		if jwt.Key == "" {
+			return errors.New("jwt: key is required")
+		}
+		if jwt.Key == cfg.Auth.JWTKey {
+			return errors.New("jwt: key must differ from auth.jwt_key")
+		}
+	}
+
+	if len(admin.Auth.ClientCerts) > 0 && (admin.TLS == nil || admin.TLS.ClientCAFile == "") {
+		return errors.New("tls.client_ca_file is required for client_certs")
+	}
+
+	for i, cert := range admin.Auth.ClientCerts {
+		if cert.CommonName == "" {
+			return fmt.Errorf("client_certs[%d]: common_name is required", i)
+		}
+		if !cert.Role.Valid() {
+			return fmt.Errorf("client_certs[%d]: invalid role %q", i, cert.Role)
+		}
+	}
+
+	for prefix, role := range admin.Auth.Endpoints {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("endpoints: %q must start with '/'", prefix)
+		}
+		if !role.Valid() {
+			return fmt.Errorf("endpoints: invalid role %q for %s", role, prefix)
+		}
+	}
+
+	return nil
+}
+
+func (rl *RateLimit) validate() error {
+	if rl == nil {
+		return nil
+	}
+
+	if rl.Delay.Duration <= 0 || rl.Timeout.Duration <= 0 {
+		return errors.New("delay and timeout must be positive")
+	}
+
+	if rl.Burst < 1 {
+		return errors.New("burst must be at least 1")
+	}
+
+	return nil
+}
+
+// Hedge sends GET and HEAD requests of a route with an upstream to
+// another target of the pool as well if the first target hasn't
+// responded within the Percentile (default 95) of the recent latencies
+// of the route, bounded by MinDelay and MaxDelay. The first response
+// is used. Hedged requests are limited to MaxExtraPercent (default 10)
+// of the requests of the route.
+type Hedge struct {
+	Percentile      float64  `json:"percentile,omitempty" yaml:"percentile,omitempty"`
+	MinDelay        Duration `json:"min_delay,omitempty" yaml:"min_delay,omitempty"`
+	MaxDelay        Duration `json:"max_delay,omitempty" yaml:"max_delay,omitempty"`
+	MaxExtraPercent int      `json:"max_extra_percent,omitempty" yaml:"max_extra_percent,omitempty"`
+}
+
+// Coalesce collapses concurrent identical GET and HEAD requests of a
+// route into one upstream request, whose response is copied to all of
+// them. Requests are identical if their URL and the request headers
+// in Vary (e.g. Accept-Encoding) are the same, Authorization and
+// Cookie are always compared. Responses larger than MaxBodyBytes
+// (default 1MiB) are not shared.
+type Coalesce struct {
+	Vary         []string `json:"vary,omitempty" yaml:"vary,omitempty"`
+	MaxBodyBytes int64    `json:"max_body_bytes,omitempty" yaml:"max_body_bytes,omitempty"`
+}
+
+// CORS answers the preflight requests of a route from AllowedOrigins
+// (e.g. "https://*.example.com", "*" allows any origin, but not with
+// AllowCredentials) for the AllowedMethods (default GET, HEAD and POST)
+// and AllowedHeaders, and adds the Access-Control-Allow-* headers to the
+// responses. MaxAge is the time browsers may cache the result of
+// preflight requests.
+type CORS struct {
+	AllowedOrigins   []string `json:"allowed_origins" yaml:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty" yaml:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty" yaml:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty" yaml:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty" yaml:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+}
+
+// Headers change the headers of the requests sent upstream and of the
+// responses to the clients, e.g. to strip Server or X-Powered-By from
+// the responses. Rules are applied in order: remove, rename (in the
+// order of the list), set and add. Values of set and add may contain
+// variables: ${path.user_id}, ${correlation_id}, ${client_ip},
+// ${jwt.sub} and ${env.NAME}. Global headers are applied before the
+// headers of the route, they can't use ${path.*} and ${jwt.*} which
+// are only set for routes.
+type Headers struct {
+	Request  HeaderRules `json:"request,omitempty" yaml:"request,omitempty"`
+	Response HeaderRules `json:"response,omitempty" yaml:"response,omitempty"`
+}
+
+// HeaderRules are the changes to the headers of
+// requests or responses.
+type HeaderRules struct {
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+	Rename []HeaderRename    `json:"rename,omitempty" yaml:"rename,omitempty"`
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty" yaml:"add,omitempty"`
+}
+
+// HeaderRename renames the header From to To.
+type HeaderRename struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+// usesVariable reports whether the header rules use variables
+// with the prefix, e.g. "env." for environment variables.
+func (h *Headers) usesVariable(prefix string) bool {
+	if h == nil {
+		return false
+	}
+	for _, values := range []map[string]string{h.Request.Set, h.Request.Add, h.Response.Set, h.Response.Add} {
+		for _, value := range values {
+			if strings.Contains(value, "${"+prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *Headers) director() (func(*http.Request), error) {
+	return directors.NewHeaders(h.Request.rules(), h.Response.rules())
+}
+
+func (r HeaderRules) rules() directors.HeaderRules {
+	rules := directors.HeaderRules{
+		Remove: r.Remove,
+		Set:    r.Set,
+		Add:    r.Add,
+	}
+	for _, rename := range r.Rename {
+		rules.Rename = append(rules.Rename, directors.HeaderRename{From: rename.From, To: rename.To})
+	}
+	return rules
+}
+
+func (r *Retry) validate() error {
+	if r == nil {
+		return nil
+	}
+
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+	}
+	if r.BudgetPercent < 0 || r.MinRetriesPerSecond < 0 {
+		return errors.New("budget must not be negative")
+	}
+	return nil
+}
+
+func (u *Upstream) validate() error {
+	if len(u.Targets) == 0 {
+		return errors.New("at least one target is required")
+	}
+
+	for i, target := range u.Targets {
+		if err := validateTarget(target.URL); err != nil {
+			return fmt.Errorf("targets[%d]: %v", i, err)
+		}
+		if target.Weight < 0 {
+			return fmt.Errorf("targets[%d]: weight must not be negative", i)
+		}
+	}
+
+	if _, err := u.policy(); err != nil {
+		return err
+	}
+
+	if hc := u.HealthCheck; hc != nil {
+		if !strings.HasPrefix(hc.Path, "/") {
+			return errors.New("health_check: path must start with /")
+		}
+		if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+			return fmt.Errorf("health_check: invalid expected_status %d", hc.ExpectedStatus)
+		}
+	}
+
+	if od := u.OutlierDetection; od != nil {
+		if od.LatencyFactor != 0 && od.LatencyFactor <= 1 {
+			return errors.New("outlier_detection: latency_factor must be greater than 1")
+		}
+		if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+			return errors.New("outlier_detection: max_ejection_percent must be between 0 and 100")
+		}
+	}
+	return nil
+}
+
+// policy returns the load balancing policy of the upstream.
+func (u *Upstream) policy() (directors.Policy, error) {
+	if u.Policy != directors.PolicyConsistentHash {
+		if u.HashKey != "" {
+			return nil, errors.New("hash_key requires the consistent_hash policy")
+		}
+		return directors.NewPolicy(u.Policy)
+	}
+
+	if u.HashKey == "" {
+		return nil, errors.New("hash_key is required by the consistent_hash policy")
+	}
+
+	key, err := directors.ParseHashKey(u.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	return directors.ConsistentHash(key), nil
+}
+
+func validateTarget(target string) error {
+	if target == "" {
+		return errors.New("target is required")
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid target %q: scheme must be http or https", target)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("invalid target %q: missing host", target)
+	}
+
+	return nil
+}
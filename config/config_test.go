@@ -0,0 +1,228 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/zgiber/proxy/auth"
+)
+
+var testYAML = `
+listen:
+  proxy: ":9001"
+correlation:
+  enabled: true
+rate_limit:
+  delay: 100ms
+  timeout: 30s
+  burst: 10
+routes:
+  - pattern: /hello
+    target: http://localhost:8080/mypath
+  - pattern: /api/:user_id/*
+    target: http://localhost:8081
+`
+
+var testJSON = `{
+	"listen": {"proxy": ":9001"},
+	"correlation": {"enabled": true},
+	"rate_limit": {"delay": "100ms", "timeout": "30s", "burst": 10},
+	"routes": [
+		{"pattern": "/hello", "target": "http://localhost:8080/mypath"},
+		{"pattern": "/api/:user_id/*", "target": "http://localhost:8081"}
+	]
+}`
+
+func TestParse(t *testing.T) {
+	for _, format := range []string{"yaml", "json"} {
+		data := testYAML
+		if format == "json" {
+			data = testJSON
+		}
+
+		cfg, err := Parse([]byte(data), format)
+		if err != nil {
+			t.Fatalf("[%v] %v", format, err)
+		}
+
+		if cfg.RateLimit.Delay.Duration != 100*time.Millisecond || cfg.RateLimit.Burst != 10 {
+			t.Fatalf("[%v] Invalid rate limit: %+v", format, cfg.RateLimit)
+		}
+
+		if len(cfg.Routes) != 2 || cfg.Routes[1].Pattern != "/api/:user_id/*" {
+			t.Fatalf("[%v] Invalid routes: %+v", format, cfg.Routes)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalidConfigs := map[string]string{
+		"missing listen": `routes: []`,
+		"invalid pattern": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a/*/b", target: "http://localhost"}]`,
+		"invalid target": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a", target: "localhost:8080"}]`,
+		"duplicate pattern": `
+listen: {proxy: ":9001"}
+routes:
+  - {pattern: "/a", target: "http://localhost"}
+  - {pattern: "/a", target: "http://localhost"}`,
+		"jwt without key": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a", target: "http://localhost", auth: jwt}]`,
+		"unknown upstream": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a", upstream: pool}]`,
+		"target and upstream": `
+listen: {proxy: ":9001"}
+upstreams: {pool: {targets: [{url: "http://localhost"}]}}
+routes: [{pattern: "/a", target: "http://localhost", upstream: pool}]`,
+		"consistent hash without key": `
+listen: {proxy: ":9001"}
+upstreams: {pool: {targets: [{url: "http://localhost"}], policy: consistent_hash}}
+routes: [{pattern: "/a", upstream: pool}]`,
+		"unknown policy": `
+listen: {proxy: ":9001"}
+upstreams: {pool: {targets: [{url: "http://localhost"}], policy: fastest}}
+routes: [{pattern: "/a", upstream: pool}]`,
+		"hedge without upstream": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a", target: "http://localhost", hedge: {}}]`,
+		"invalid header template": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a", target: "http://localhost", headers: {request: {set: {X-User: "${user}"}}}}]`,
+		"admin without auth": `
+listen: {proxy: ":9001", admin: ":9002"}
+routes: [{pattern: "/a", target: "http://localhost"}]`,
+		"admin jwt with the key of the routes": `
+listen: {proxy: ":9001", admin: ":9002"}
+auth: {jwt_key: secret}
+admin: {auth: {jwt: {key: secret}}}
+routes: [{pattern: "/a", target: "http://localhost"}]`,
+		"cors with any origin and credentials": `
+listen: {proxy: ":9001"}
+routes: [{pattern: "/a", target: "http://localhost", cors: {allowed_origins: ["*"], allow_credentials: true}}]`,
+		"path variable in global headers": `
+listen: {proxy: ":9001"}
+headers: {request: {set: {X-User: "${path.user_id}"}}}
+routes: [{pattern: "/a/:user_id", target: "http://localhost"}]`,
+		"invalid error rate": `
+listen: {proxy: ":9001"}
+circuit_breaker: {error_rate: 1.5}
+routes: [{pattern: "/a", target: "http://localhost"}]`,
+	}
+
+	for name, data := range invalidConfigs {
+		if _, err := Parse([]byte(data), "yaml"); err == nil {
+			t.Fatalf("[%v] Expected validation error", name)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.URL.Path))
+	}))
+	defer upstream.Close()
+
+	cfg, err := Parse([]byte(`
+listen: {proxy: ":9001"}
+routes:
+  - {pattern: "/users/:user_id", target: "`+upstream.URL+`/profiles/:user_id"}
+  - {pattern: "/private", target: "`+upstream.URL+`", auth: jwt}
+  - {pattern: "/pool/:user_id", upstream: pool}
+upstreams:
+  pool:
+    targets: [{url: "`+upstream.URL+`/pool/:user_id", weight: 2}]
+    policy: least_outstanding
+auth: {jwt_key: secret}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reverseProxy, err := Build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/users/user123", http.StatusOK, "/profiles/user123"},
+		{"/private", http.StatusUnauthorized, ""},
+		{"/pool/user123", http.StatusOK, "/pool/user123"},
+		{"/nomatch", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		reverseProxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost"+test.path, nil))
+
+		if rec.Code != test.expectedStatus {
+			t.Fatalf("[%v] Invalid status. Expected:%v Got:%v", test.path, test.expectedStatus, rec.Code)
+		}
+
+		if test.expectedBody != "" && !strings.Contains(rec.Body.String(), test.expectedBody) {
+			t.Fatalf("[%v] Invalid body. Expected:%v Got:%v", test.path, test.expectedBody, rec.Body)
+		}
+	}
+	// tokens are verified with the configured key, not the package default
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+	for key, expectedStatus := range map[string]int{"secret": http.StatusOK, auth.JWTPrivateKey: http.StatusUnauthorized} {
+		signed, _ := token.SignedString([]byte(key))
+		req := httptest.NewRequest("GET", "http://localhost/private", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+
+		rec := httptest.NewRecorder()
+		reverseProxy.ServeHTTP(rec, req)
+		if rec.Code != expectedStatus {
+			t.Fatalf("[%v] Invalid status. Expected:%v Got:%v", key, expectedStatus, rec.Code)
+		}
+	}
+}
+
+func TestOpenCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "capture.jsonl")
+	recorder, err := OpenCapture(&Capture{Output: path, RedactHeaders: []string{"X-Api-Key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Api-Key", "secret-key")
+	recorder.Handler(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Invalid file mode. Expected:0600 Got:%v", info.Mode().Perm())
+	}
+
+	// the default headers are redacted along with the configured ones
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "secret-token") || strings.Contains(string(data), "secret-key") {
+		t.Fatalf("Expected redacted headers, got %s", data)
+	}
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Diff returns a line based diff of two configuration files.
+// Removed lines are prefixed with "-", added lines with "+",
+// unchanged lines are omitted. An empty string means no difference.
+func Diff(a, b []byte) string {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+
+	// longest common subsequence table
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			switch {
+			case aLines[i] == bLines[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			i++
+			j++
+
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] > lcs[i+1][j]):
+			buf.WriteString("+" + bLines[j] + "\n")
+			j++
+
+		default:
+			buf.WriteString("-" + aLines[i] + "\n")
+			i++
+		}
+	}
+
+	return buf.String()
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimRight(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
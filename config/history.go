@@ -0,0 +1,282 @@
+package config
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/auth"
+	"github.com/zgiber/proxy/directors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxRevisions is the number of revisions kept in the history.
+const maxRevisions = 100
+
+// Revision is an immutable snapshot of the configuration which was
+// activated by a change (loading the file, a call to the API or a
+// rollback).
+type Revision struct {
+	ID        int       `json:"id"`
+	Version   string    `json:"version"`
+	Author    string    `json:"author"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	data      []byte    // used for rollbacks
+	redacted  []byte    // served by the API
+}
+
+// history keeps the latest revisions of the configuration.
+type history struct {
+	sync.RWMutex
+	revisions []*Revision
+	nextID    int
+}
+
+// change describes who changed the configuration and why.
+type change struct {
+	author string
+	reason string
+}
+
+// changeFromRequest returns the change made by an API request.
+// The author is the authenticated client, the reason is taken
+// from the X-Change-Reason header.
+func changeFromRequest(req *http.Request) change {
+	author := "anonymous"
+	if identity, ok := auth.IdentityFromRequest(req); ok && identity.Name != "" {
+		author = identity.Name
+	}
+
+	return change{
+		author: author,
+		reason: req.Header.Get("X-Change-Reason"),
+	}
+}
+
+func (h *history) add(revision *Revision) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.nextID++
+	revision.ID = h.nextID
+	h.revisions = append(h.revisions, revision)
+	if len(h.revisions) > maxRevisions {
+		h.revisions = h.revisions[len(h.revisions)-maxRevisions:]
+	}
+}
+
+func (h *history) get(id int) (*Revision, bool) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, revision := range h.revisions {
+		if revision.ID == id {
+			return revision, true
+		}
+	}
+	return nil, false
+}
+
+func (h *history) list() []*Revision {
+	h.RLock()
+	defer h.RUnlock()
+
+	revisions := make([]*Revision, len(h.revisions))
+	copy(revisions, h.revisions)
+	return revisions
+}
+
+// Revisions returns the revisions of the configuration, oldest first.
+func (m *Manager) Revisions() []*Revision {
+	return m.history.list()
+}
+
+// Rollback activates the configuration of a previous revision.
+// The rollback itself is recorded as a new revision.
+func (m *Manager) Rollback(id int, author, reason string) (*Revision, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.rollback(id, change{author: author, reason: reason})
+}
+
+func (m *Manager) rollback(id int, ch change) (*Revision, error) {
+	revision, ok := m.history.get(id)
+	if !ok {
+		return nil, directors.ErrNotFound("no such revision")
+	}
+
+	cfg, err := Parse(revision.data, "yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	if ch.reason == "" {
+		ch.reason = "rollback to revision " + strconv.Itoa(id)
+	}
+
+	// the content of the file is kept, so the next reload
+	// keeps the routes of the revision which the file doesn't change
+	if err := m.activate(cfg, m.current().data); err != nil {
+		return nil, err
+	}
+	return m.record(ch), nil
+}
+
+// record adds the active configuration to the history.
+func (m *Manager) record(ch change) *Revision {
+	current := m.current()
+
+	data, err := yaml.Marshal(current.cfg)
+	if err != nil {
+		data = current.data
+	}
+
+	redacted, err := yaml.Marshal(current.cfg.redacted())
+	if err != nil {
+		redacted = nil
+	}
+
+	revision := &Revision{
+		Version:   current.version,
+		Author:    ch.author,
+		Reason:    ch.reason,
+		Timestamp: current.loadedAt,
+		data:      data,
+		redacted:  redacted,
+	}
+	m.history.add(revision)
+	return revision
+}
+
+// serveRevisions is the handler of the revisions API:
+//
+//	GET  /revisions                    lists the revisions
+//	GET  /revisions/{id}               returns a revision with its configuration
+//	GET  /revisions/diff?from=1&to=2   returns the diff of two revisions
+//	POST /revisions/{id}/rollback      activates the configuration of a revision
+func (m *Manager) serveRevisions(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/revisions"), "/")
+	segments := strings.Split(path, "/")
+
+	switch {
+	case path == "" && req.Method == "GET":
+		writeJSON(rw, http.StatusOK, m.Revisions())
+
+	case path == "diff" && req.Method == "GET":
+		from, okFrom := m.revisionParam(req.URL.Query().Get("from"))
+		to, okTo := m.revisionParam(req.URL.Query().Get("to"))
+		if !okFrom || !okTo {
+			proxy.WriteError(rw, req, directors.ErrNotFound("no such revision"))
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"from": from.ID,
+			"to":   to.ID,
+			"diff": Diff(from.redacted, to.redacted),
+		})
+
+	case len(segments) == 1 && req.Method == "GET":
+		revision, ok := m.revisionParam(segments[0])
+		if !ok {
+			proxy.WriteError(rw, req, directors.ErrNotFound("no such revision"))
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"revision": revision,
+			"config":   string(revision.redacted),
+		})
+
+	case len(segments) == 2 && segments[1] == "rollback" && req.Method == "POST":
+		id, err := strconv.Atoi(segments[0])
+		if err != nil {
+			proxy.WriteError(rw, req, directors.ErrNotFound("no such revision"))
+			return
+		}
+
+		m.Lock()
+		revision, err := m.rollback(id, changeFromRequest(req))
+		m.Unlock()
+		if err != nil {
+			if _, ok := err.(*directors.ProxyError); !ok {
+				err = directors.ErrBadRequest(err.Error())
+			}
+			proxy.WriteError(rw, req, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, revision)
+
+	case len(segments) == 2 && segments[1] == "rollback":
+		methodNotAllowed(rw, req, "POST")
+
+	default:
+		methodNotAllowed(rw, req, "GET")
+	}
+}
+
+func (m *Manager) revisionParam(param string) (*Revision, bool) {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		return nil, false
+	}
+	return m.history.get(id)
+}
+
+// redacted returns a copy of the configuration without secrets.
+// The values of header rules may contain secrets (e.g. API keys).
+func (cfg *Config) redacted() *Config {
+	c := cfg.clone()
+
+	if c.Auth.JWTKey != "" {
+		c.Auth.JWTKey = "REDACTED"
+	}
+
+	if c.Admin.Auth != nil {
+		adminAuth := *c.Admin.Auth
+		adminAuth.Tokens = make([]TokenIdentity, len(c.Admin.Auth.Tokens))
+		for i, token := range c.Admin.Auth.Tokens {
+			token.Token = "REDACTED"
+			adminAuth.Tokens[i] = token
+		}
+		if adminAuth.JWT != nil {
+			jwt := *adminAuth.JWT
+			jwt.Key = "REDACTED"
+			adminAuth.JWT = &jwt
+		}
+		c.Admin.Auth = &adminAuth
+	}
+
+	if c.Headers != nil {
+		c.Headers = c.Headers.redacted()
+	}
+	for i, route := range c.Routes {
+		c.Routes[i] = route.redacted()
+	}
+
+	return c
+}
+
+// redacted returns a copy of the header rules without their values.
+func (h *Headers) redacted() *Headers {
+	c := *h
+	c.Request.Set, c.Request.Add = redactValues(h.Request.Set), redactValues(h.Request.Add)
+	c.Response.Set, c.Response.Add = redactValues(h.Response.Set), redactValues(h.Response.Add)
+	return &c
+}
+
+func redactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	redacted := map[string]string{}
+	for name := range values {
+		redacted[name] = "REDACTED"
+	}
+	return redacted
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRevisions(t *testing.T) {
+	m, cleanup := newTestManager(t, `
+listen: {proxy: ":9001"}
+auth: {jwt_key: secret}
+routes:
+  - {pattern: /a, target: "http://localhost:8080"}
+`)
+	defer cleanup()
+
+	api := httptest.NewServer(m.Proxy().ConfigAPI())
+	defer api.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Change-Reason", "testing")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	do("PUT", "/routes/b", `{"target": "http://localhost:8081"}`).Body.Close()
+	do("DELETE", "/routes/a", "").Body.Close()
+
+	revisions := m.Revisions()
+	if len(revisions) != 3 {
+		t.Fatalf("Invalid number of revisions. Expected:3 Got:%v", len(revisions))
+	}
+
+	if revisions[1].Author != "anonymous" || revisions[1].Reason != "testing" {
+		t.Fatalf("Invalid revision: %+v", revisions[1])
+	}
+
+	resp := do("GET", "/revisions/diff?from=1&to=3", "")
+	diff := map[string]interface{}{}
+	json.NewDecoder(resp.Body).Decode(&diff)
+	resp.Body.Close()
+
+	d, _ := diff["diff"].(string)
+	if !strings.Contains(d, "-- pattern: /a") || !strings.Contains(d, "+- pattern: /b") {
+		t.Fatalf("Invalid diff:\n%v", d)
+	}
+
+	resp = do("GET", "/revisions/1", "")
+	body := map[string]interface{}{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if config, _ := body["config"].(string); strings.Contains(config, "secret") {
+		t.Fatalf("Secrets are not redacted:\n%v", config)
+	}
+
+	resp = do("POST", "/revisions/1/rollback", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid status on rollback: %v", resp.StatusCode)
+	}
+
+	if _, ok := m.Config().route("/a"); !ok {
+		t.Fatal("Route /a is missing after rollback")
+	}
+
+	if _, ok := m.Config().route("/b"); ok {
+		t.Fatal("Route /b exists after rollback")
+	}
+
+	if len(m.Revisions()) != 4 || m.Version() != revisions[0].Version {
+		t.Fatalf("Rollback is not recorded as the revision of the original version: %+v", m.Revisions())
+	}
+
+	if resp := do("POST", "/revisions/99/rollback", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown revision, got %v", resp.StatusCode)
+	}
+}
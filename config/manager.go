@@ -0,0 +1,429 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/accesslog"
+	"github.com/zgiber/proxy/breaker"
+	"github.com/zgiber/proxy/cache"
+	"github.com/zgiber/proxy/directors"
+	"github.com/zgiber/proxy/metrics"
+	"github.com/zgiber/proxy/tracing"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manager keeps the active configuration of a ReverseProxy built
+// from a configuration file. The file can be reloaded at any time,
+// the new router and director chain are swapped in atomically.
+// Requests which are already in flight finish with the configuration
+// they started with.
+type Manager struct {
+	sync.Mutex // serializes reloads
+	path       string
+	proxy      *proxy.ReverseProxy
+	active     atomic.Value // *activeConfig
+	history    *history
+	metrics    *metrics.Metrics
+}
+
+// activeConfig is an immutable snapshot of a loaded configuration
+// and the directors built from it.
+type activeConfig struct {
+	cfg       *Config
+	data      []byte
+	version   string
+	loadedAt  time.Time
+	director  func(*http.Request)
+	router    *directors.Router
+	upstreams map[string]*directors.LoadBalancer
+
+	accessLog     *accesslog.Logger
+	accessLogFile *sharedFile
+	tracer        *tracing.Tracer
+	breakers      *breaker.Set
+	cache         *cache.Cache
+	compress      func(*http.Response) error
+}
+
+// NewManager loads the configuration file at path and returns a
+// Manager with a ReverseProxy built from it. The active version
+// is served on "/config/version" of the configuration API, routes
+// can be managed on "/routes/{pattern}", the history of changes
+// on "/revisions", the state of upstreams is served on "/upstreams",
+// the state of circuit breakers on "/circuit_breakers", the response
+// cache on "/cache" and metrics on "/metrics".
+func NewManager(path string) (*Manager, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := Parse(data, formatOf(path))
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newManager(path, cfg, data)
+	if err != nil {
+		return nil, err
+	}
+	m.record(change{author: "file", reason: "load " + path})
+	return m, nil
+}
+
+// newManager activates the configuration and sets
+// up the ReverseProxy and the configuration API.
+func newManager(path string, cfg *Config, data []byte) (*Manager, error) {
+	m := &Manager{
+		path:    path,
+		proxy:   proxy.New(),
+		history: &history{},
+		metrics: metrics.New(),
+	}
+	if err := m.activate(cfg, data); err != nil {
+		return nil, err
+	}
+
+	m.proxy.AddDirector(m.direct)
+	m.proxy.AddObserver(m.observe)
+	m.proxy.AddResponseModifier(m.modifyResponse)
+	m.proxy.AddObserver(m.metrics.Observe)
+	m.proxy.HandleConfig("/config/version", http.HandlerFunc(m.serveVersion))
+	m.proxy.HandleConfig("/routes", http.HandlerFunc(m.serveRoutes))
+	m.proxy.HandleConfig("/routes/", http.HandlerFunc(m.serveRoutes))
+	m.proxy.HandleConfig("/revisions", http.HandlerFunc(m.serveRevisions))
+	m.proxy.HandleConfig("/revisions/", http.HandlerFunc(m.serveRevisions))
+	m.proxy.HandleConfig("/upstreams", http.HandlerFunc(m.serveUpstreams))
+	m.proxy.HandleConfig("/upstreams/", http.HandlerFunc(m.serveUpstreams))
+	m.proxy.HandleConfig("/circuit_breakers", http.HandlerFunc(m.serveCircuitBreakers))
+	m.proxy.HandleConfig("/cache", http.HandlerFunc(m.serveCache))
+	m.proxy.HandleConfig("/metrics", m.metrics)
+	return m, nil
+}
+
+// Proxy returns the ReverseProxy which is configured by the Manager.
+func (m *Manager) Proxy() *proxy.ReverseProxy {
+	return m.proxy
+}
+
+// Config returns the active configuration.
+// It must not be modified by the caller.
+func (m *Manager) Config() *Config {
+	return m.current().cfg
+}
+
+// Version returns the version of the active configuration, which
+// is derived from its content. Rolling back to a revision restores
+// its version as well.
+func (m *Manager) Version() string {
+	return m.current().version
+}
+
+// Reload reads the configuration file and activates it if it has
+// changed. Invalid configurations are rejected and logged with
+// the diff to the active configuration, the active configuration
+// stays in place.
+func (m *Manager) Reload() error {
+	m.Lock()
+	defer m.Unlock()
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	current := m.current()
+	if bytes.Equal(data, current.data) {
+		return nil
+	}
+
+	cfg, err := Parse(data, formatOf(m.path))
+	if err != nil {
+		log.Printf("rejected configuration %s: %v\n%s", m.path, err, Diff(current.data, data))
+		return err
+	}
+
+	// keep the routes changed through the API
+	if previous, err := Parse(current.data, formatOf(m.path)); err == nil {
+		if conflicts := cfg.mergeRoutes(previous, current.cfg); len(conflicts) > 0 {
+			log.Printf("configuration %s: routes changed through the API are replaced by the file: %s",
+				m.path, strings.Join(conflicts, ", "))
+		}
+		if err := cfg.Validate(); err != nil {
+			log.Printf("rejected configuration %s: %v\n%s", m.path, err, Diff(current.data, data))
+			return err
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.Listen, current.cfg.Listen) {
+		log.Printf("configuration %s: changes of listen are applied after restart", m.path)
+	}
+
+	if err := m.activate(cfg, data); err != nil {
+		log.Printf("rejected configuration %s: %v", m.path, err)
+		return err
+	}
+	m.record(change{author: "file", reason: "reload " + m.path})
+	log.Printf("configuration %s reloaded, version %s\n%s", m.path, m.Version(), Diff(current.data, data))
+	return nil
+}
+
+// Watch reloads the configuration when the file changes (checked
+// at the given interval) or when the process receives SIGHUP.
+// It blocks until stop is closed.
+func (m *Manager) Watch(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modTime := m.modTime()
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-hup:
+			if err := m.Reload(); err != nil {
+				log.Println(err)
+			}
+
+		case <-ticker.C:
+			if t := m.modTime(); !t.Equal(modTime) {
+				modTime = t
+				if err := m.Reload(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+func (m *Manager) modTime() time.Time {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (m *Manager) current() *activeConfig {
+	return m.active.Load().(*activeConfig)
+}
+
+func (m *Manager) activate(cfg *Config, data []byte) error {
+	previous, _ := m.active.Load().(*activeConfig)
+
+	active := &activeConfig{
+		cfg:  cfg,
+		data: data,
+	}
+
+	// keep the access log open if it's not changed
+	if previous != nil && reflect.DeepEqual(cfg.AccessLog, previous.cfg.AccessLog) {
+		active.accessLog, active.accessLogFile = previous.accessLog, previous.accessLogFile
+	} else {
+		accessLog, file, err := openAccessLog(cfg.AccessLog)
+		if err != nil {
+			return err
+		}
+		active.accessLog, active.accessLogFile = accessLog, newSharedFile(file)
+	}
+
+	// keep the tracer (and its buffered spans) if it's not changed
+	if previous != nil && reflect.DeepEqual(cfg.Tracing, previous.cfg.Tracing) {
+		active.tracer = previous.tracer
+	} else {
+		active.tracer = newTracer(cfg.Tracing)
+	}
+
+	// keep the state of the circuit breakers if they are not changed
+	if previous != nil && reflect.DeepEqual(cfg.CircuitBreaker, previous.cfg.CircuitBreaker) {
+		active.breakers = previous.breakers
+	} else {
+		active.breakers = newCircuitBreakers(cfg.CircuitBreaker)
+	}
+
+	// keep the stored responses if the cache is not changed
+	if previous != nil && reflect.DeepEqual(cfg.Cache, previous.cfg.Cache) {
+		active.cache = previous.cache
+	} else {
+		active.cache = newCache(cfg.Cache)
+	}
+	active.compress = newCompression(cfg.Compression)
+
+	m.proxy.SetConfigAuth(buildAdminAuth(cfg))
+
+	// keep the load balancers (with the health of their
+	// targets) of the upstreams which are not changed
+	active.upstreams = map[string]*directors.LoadBalancer{}
+	for name, upstream := range cfg.Upstreams {
+		if previous != nil && reflect.DeepEqual(upstream, previous.cfg.Upstreams[name]) {
+			active.upstreams[name] = previous.upstreams[name]
+		} else {
+			active.upstreams[name] = buildUpstream(name, upstream, m.metrics)
+		}
+	}
+
+	active.director, active.router = buildDirector(cfg, active.upstreams)
+	m.store(active)
+	m.proxy.SetCircuitBreakers(active.breakers)
+	m.proxy.SetCache(active.cache)
+
+	if previous != nil && previous.accessLogFile != active.accessLogFile {
+		// closed when the requests directed with it are logged
+		previous.accessLogFile.release()
+	}
+	if previous != nil && previous.tracer != nil && previous.tracer != active.tracer {
+		go previous.tracer.Close()
+	}
+	if previous != nil {
+		for name, lb := range previous.upstreams {
+			if active.upstreams[name] != lb {
+				lb.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// sharedFile closes the file when the last of its users releases
+// it: the configuration it's opened for and the requests directed
+// with that configuration. A nil sharedFile has no file to close.
+type sharedFile struct {
+	sync.Mutex
+	file  io.Closer
+	users int
+}
+
+func newSharedFile(file io.Closer) *sharedFile {
+	if file == nil {
+		return nil
+	}
+	return &sharedFile{file: file, users: 1}
+}
+
+// acquire adds a user. It reports false if the file is closed.
+func (f *sharedFile) acquire() bool {
+	if f == nil {
+		return true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.users == 0 {
+		return false
+	}
+	f.users++
+	return true
+}
+
+// release removes a user, the last one closes the file.
+func (f *sharedFile) release() {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.users--
+	if f.users == 0 {
+		f.file.Close()
+	}
+}
+
+// store makes the configuration active. Its version
+// and load time are set by store.
+func (m *Manager) store(active *activeConfig) {
+	// the version only depends on the configuration, not on
+	// the formatting or comments of the file
+	canonical, err := yaml.Marshal(active.cfg)
+	if err != nil {
+		canonical = active.data
+	}
+
+	sum := sha256.Sum256(canonical)
+	active.version = hex.EncodeToString(sum[:])[:12]
+	active.loadedAt = time.Now().UTC()
+	m.active.Store(active)
+}
+
+// direct runs the director chain of the active configuration.
+// The configuration is loaded once and kept in the RequestInfo, so
+// the whole chain, the response modifiers and the observers work
+// with the same configuration even if it is swapped meanwhile.
+func (m *Manager) direct(req *http.Request) {
+	current := m.current()
+	for !current.accessLogFile.acquire() {
+		// replaced and closed meanwhile
+		current = m.current()
+	}
+	directors.GetRequestInfo(req).Config = current
+	current.director(req)
+}
+
+// requestConfig returns the configuration the request
+// was directed with, or the active one.
+func (m *Manager) requestConfig(info *directors.RequestInfo) *activeConfig {
+	if current, ok := info.Config.(*activeConfig); ok {
+		return current
+	}
+	return m.current()
+}
+
+// observe writes the access log and exports the spans
+// of the configuration the request was directed with.
+func (m *Manager) observe(info *directors.RequestInfo) {
+	current, directed := info.Config.(*activeConfig)
+	if directed {
+		defer current.accessLogFile.release()
+	} else {
+		current = m.current()
+	}
+
+	if current.accessLog != nil {
+		current.accessLog.Log(info)
+	}
+	if current.tracer != nil {
+		current.tracer.Observe(info)
+	}
+}
+
+// modifyResponse applies the response modifiers of the
+// configuration the request was directed with.
+func (m *Manager) modifyResponse(resp *http.Response) error {
+	if compress := m.requestConfig(directors.GetRequestInfo(resp.Request)).compress; compress != nil {
+		return compress(resp)
+	}
+	return nil
+}
+
+func (m *Manager) serveVersion(rw http.ResponseWriter, req *http.Request) {
+	current := m.current()
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"version":   current.version,
+		"loaded_at": current.loadedAt,
+	})
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManagerReload(t *testing.T) {
+	upstreamA := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("A"))
+	}))
+	defer upstreamA.Close()
+
+	upstreamB := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("B"))
+	}))
+	defer upstreamB.Close()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.yaml")
+	writeConfig := func(target string) {
+		data := "listen: {proxy: \":9001\"}\nroutes:\n  - {pattern: /hello, target: \"" + target + "\"}\n"
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectBody := func(m *Manager, expected string) {
+		rec := httptest.NewRecorder()
+		m.Proxy().ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/hello", nil))
+		if body := rec.Body.String(); body != expected {
+			t.Fatalf("Invalid response. Expected:%v Got:%v", expected, body)
+		}
+	}
+
+	writeConfig(upstreamA.URL)
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBody(m, "A")
+	versionA := m.Version()
+
+	writeConfig(upstreamB.URL)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	expectBody(m, "B")
+
+	if m.Version() == versionA {
+		t.Fatal("Version did not change after reload")
+	}
+
+	// invalid configurations are rejected
+	writeConfig("not a url")
+	if err := m.Reload(); err == nil {
+		t.Fatal("Expected invalid configuration to be rejected")
+	}
+	expectBody(m, "B")
+}
+
+func TestManagerReloadInFlight(t *testing.T) {
+	received, release := make(chan bool), make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received <- true
+		<-release
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.yaml")
+	logPath := filepath.Join(dir, "access.log")
+	writeConfig := func(accessLog string) {
+		data := "listen: {proxy: \":9001\"}\n" + accessLog + "routes:\n  - {pattern: /hello, target: \"" + upstream.URL + "\"}\n"
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("access_log: {output: \"" + logPath + "\"}\n")
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		m.Proxy().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/hello", nil))
+		done <- true
+	}()
+	<-received
+
+	// the access log is disabled while the request is in flight
+	writeConfig("")
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+
+	data, _ := ioutil.ReadFile(logPath)
+	if !strings.Contains(string(data), "/hello") {
+		t.Fatalf("Expected the request to be logged with its configuration, got %q", data)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := "listen: {proxy: \":9001\"}\nroutes:\n  - {pattern: /a}\n  - {pattern: /b}\n"
+	b := "listen: {proxy: \":9001\"}\nroutes:\n  - {pattern: /a}\n  - {pattern: /c}\n"
+
+	diff := Diff([]byte(a), []byte(b))
+	if diff != "-  - {pattern: /b}\n+  - {pattern: /c}\n" {
+		t.Fatalf("Invalid diff:\n%v", diff)
+	}
+
+	if diff := Diff([]byte(a), []byte(a)); strings.TrimSpace(diff) != "" {
+		t.Fatalf("Expected empty diff, got:\n%v", diff)
+	}
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/directors"
+)
+
+// serveRoutes is the handler of the routes API:
+//
+//	GET    /routes            lists the routes
+//	GET    /routes/{pattern}  returns a route
+//	PUT    /routes/{pattern}  adds or replaces a route
+//	DELETE /routes/{pattern}  removes a route
+//
+// Changes are applied to the live router and recorded as revisions
+// with the reason given in the X-Change-Reason header. They are kept
+// when the configuration file is reloaded, unless the file changes the
+// same route. The values of header rules are redacted.
+func (m *Manager) serveRoutes(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/routes" {
+		if req.Method != "GET" {
+			methodNotAllowed(rw, req, "GET")
+			return
+		}
+		routes := []Route{}
+		for _, route := range m.Config().Routes {
+			routes = append(routes, route.redacted())
+		}
+		writeJSON(rw, http.StatusOK, routes)
+		return
+	}
+
+	pattern := strings.TrimPrefix(req.URL.Path, "/routes")
+
+	switch req.Method {
+	case "GET":
+		route, ok := m.Config().route(pattern)
+		if !ok {
+			proxy.WriteError(rw, req, directors.ErrNotFound("no such route"))
+			return
+		}
+		writeJSON(rw, http.StatusOK, route.redacted())
+
+	case "PUT":
+		route := Route{}
+		if err := json.NewDecoder(req.Body).Decode(&route); err != nil {
+			proxy.WriteError(rw, req, directors.ErrBadRequest(err.Error()))
+			return
+		}
+		route.Pattern = pattern
+
+		// the values would be sent to the target of the route
+		if route.Headers.usesVariable("env.") {
+			proxy.WriteError(rw, req, directors.ErrBadRequest("${env.*} is only allowed in the configuration file"))
+			return
+		}
+
+		created, err := m.setRoute(route, changeFromRequest(req))
+		if err != nil {
+			proxy.WriteError(rw, req, directors.ErrBadRequest(err.Error()))
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(rw, status, route.redacted())
+
+	case "DELETE":
+		if !m.deleteRoute(pattern, changeFromRequest(req)) {
+			proxy.WriteError(rw, req, directors.ErrNotFound("no such route"))
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(rw, req, "GET, PUT, DELETE")
+	}
+}
+
+// setRoute validates the route in the context of the active
+// configuration and adds it to (or replaces it on) the live router.
+func (m *Manager) setRoute(route Route, ch change) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	current := m.current()
+	cfg := current.cfg.clone()
+
+	_, exists := cfg.route(route.Pattern)
+	cfg.setRoute(route)
+
+	if err := cfg.Validate(); err != nil {
+		return false, err
+	}
+
+	if _, err := current.router.Set(route.Pattern, buildRoute(route, cfg.Auth, current.upstreams)); err != nil {
+		return false, err
+	}
+
+	m.storeChange(cfg, ch)
+	return !exists, nil
+}
+
+// deleteRoute removes the route from the live router.
+func (m *Manager) deleteRoute(pattern string, ch change) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	current := m.current()
+	if !current.router.Delete(pattern) {
+		return false
+	}
+
+	cfg := current.cfg.clone()
+	cfg.deleteRoute(pattern)
+
+	m.storeChange(cfg, ch)
+	return true
+}
+
+// storeChange activates a configuration which was changed through
+// the API and records it as a new revision. The directors are kept
+// since the changes are already applied on the live router.
+// Its data stays the content of the configuration file, so reloads
+// can tell the changes of the file from the changes of the API.
+func (m *Manager) storeChange(cfg *Config, ch change) {
+	active := *m.current()
+	active.cfg = cfg
+	m.store(&active)
+	m.record(ch)
+}
+
+// mergeRoutes applies the route changes of the API to cfg, which
+// is read from the configuration file. The changes are the difference
+// between the previous content of the file and the live configuration.
+// Routes which are changed in the file as well are taken from the file,
+// their patterns are returned.
+func (cfg *Config) mergeRoutes(previousFile, live *Config) []string {
+	patterns := []string{}
+	seen := map[string]bool{}
+	for _, routes := range [][]Route{previousFile.Routes, live.Routes} {
+		for _, route := range routes {
+			if !seen[route.Pattern] {
+				seen[route.Pattern] = true
+				patterns = append(patterns, route.Pattern)
+			}
+		}
+	}
+
+	conflicts := []string{}
+	for _, pattern := range patterns {
+		previous, inPrevious := previousFile.route(pattern)
+		changed, inLive := live.route(pattern)
+		if inPrevious == inLive && (!inLive || reflect.DeepEqual(previous, changed)) {
+			// not changed through the API
+			continue
+		}
+
+		current, inFile := cfg.route(pattern)
+		if inFile != inPrevious || inFile && !reflect.DeepEqual(current, previous) {
+			conflicts = append(conflicts, pattern)
+			continue
+		}
+
+		if inLive {
+			cfg.setRoute(changed)
+		} else {
+			cfg.deleteRoute(pattern)
+		}
+	}
+	return conflicts
+}
+
+// setRoute adds the route or replaces the one with its pattern.
+func (cfg *Config) setRoute(route Route) {
+	for i := range cfg.Routes {
+		if cfg.Routes[i].Pattern == route.Pattern {
+			cfg.Routes[i] = route
+			return
+		}
+	}
+	cfg.Routes = append(cfg.Routes, route)
+}
+
+// deleteRoute removes the route with the pattern.
+func (cfg *Config) deleteRoute(pattern string) {
+	routes := cfg.Routes[:0]
+	for _, route := range cfg.Routes {
+		if route.Pattern != pattern {
+			routes = append(routes, route)
+		}
+	}
+	cfg.Routes = routes
+}
+
+// redacted returns a copy of the route without
+// the values of its header rules.
+func (route Route) redacted() Route {
+	if route.Headers != nil {
+		route.Headers = route.Headers.redacted()
+	}
+	return route
+}
+
+// route returns the route with the given pattern.
+func (cfg *Config) route(pattern string) (Route, bool) {
+	for _, route := range cfg.Routes {
+		if route.Pattern == pattern {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// clone returns a copy of the configuration which can
+// be modified without affecting the original.
+func (cfg *Config) clone() *Config {
+	c := *cfg
+	c.Routes = make([]Route, len(cfg.Routes))
+	copy(c.Routes, cfg.Routes)
+	return &c
+}
+
+func methodNotAllowed(rw http.ResponseWriter, req *http.Request, allowed string) {
+	rw.Header().Set("Allow", allowed)
+	proxy.WriteError(rw, req, directors.NewProxyError(http.StatusMethodNotAllowed, "method_not_allowed", req.Method+" is not allowed"))
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestManager(t *testing.T, data string) (*Manager, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "proxy.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, func() { os.RemoveAll(dir) }
+}
+
+func TestRoutesAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.URL.Path))
+	}))
+	defer upstream.Close()
+
+	m, cleanup := newTestManager(t, "listen: {proxy: \":9001\"}\nroutes: []\n")
+	defer cleanup()
+
+	api := httptest.NewServer(m.Proxy().ConfigAPI())
+	defer api.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	proxyPath := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		m.Proxy().ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost"+path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, _ := proxyPath("/users/user123"); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 before adding the route, got %v", code)
+	}
+
+	tests := []struct {
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{"PUT", "/routes/users/:user_id", `{"target": "` + upstream.URL + `/profiles/:user_id"}`, http.StatusCreated},
+		{"PUT", "/routes/users/:user_id", `{"target": "` + upstream.URL + `/accounts/:user_id"}`, http.StatusOK},
+		{"PUT", "/routes/users/:id/details", `{"target": "` + upstream.URL + `"}`, http.StatusBadRequest},
+		{"PUT", "/routes/invalid", `{"target": "localhost"}`, http.StatusBadRequest},
+		{"PUT", "/routes/env", `{"target": "` + upstream.URL + `", "headers": {"request": {"set": {"X-Key": "${env.HOME}"}}}}`, http.StatusBadRequest},
+		{"GET", "/routes/users/:user_id", "", http.StatusOK},
+		{"GET", "/routes/nomatch", "", http.StatusNotFound},
+		{"POST", "/routes/users/:user_id", "", http.StatusMethodNotAllowed},
+	}
+
+	for i, test := range tests {
+		if resp := do(test.method, test.path, test.body); resp.StatusCode != test.expectedStatus {
+			t.Fatalf("[%v] Invalid status. Expected:%v Got:%v", i, test.expectedStatus, resp.StatusCode)
+		}
+	}
+
+	if code, body := proxyPath("/users/user123"); code != http.StatusOK || body != "/accounts/user123" {
+		t.Fatalf("Invalid response after replacing the route: %v %v", code, body)
+	}
+
+	routes := []Route{}
+	resp, _ := http.Get(api.URL + "/routes")
+	json.NewDecoder(resp.Body).Decode(&routes)
+	resp.Body.Close()
+	if len(routes) != 1 || routes[0].Pattern != "/users/:user_id" {
+		t.Fatalf("Invalid routes: %+v", routes)
+	}
+
+	if resp := do("DELETE", "/routes/users/:user_id", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Invalid status on delete: %v", resp.StatusCode)
+	}
+
+	if code, _ := proxyPath("/users/user123"); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after deleting the route, got %v", code)
+	}
+}
+
+func TestRoutesKeptOnReload(t *testing.T) {
+	m, cleanup := newTestManager(t, `
+listen: {proxy: ":9001"}
+routes:
+  - {pattern: "/a", target: "http://localhost:8081"}
+  - {pattern: "/b", target: "http://localhost:8081"}
+`)
+	defer cleanup()
+
+	route := Route{
+		Pattern: "/c",
+		Target:  "http://localhost:8082",
+		Headers: &Headers{Request: HeaderRules{Set: map[string]string{"X-Api-Key": "secret"}}},
+	}
+	if _, err := m.setRoute(route, change{author: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	m.deleteRoute("/b", change{author: "test"})
+	route.Pattern = "/a"
+	m.setRoute(route, change{author: "test"})
+
+	// the file changes /a as well, so the file wins for /a
+	data := `
+listen: {proxy: ":9001"}
+rate_limit: {delay: 100ms, timeout: 30s, burst: 10}
+routes:
+  - {pattern: "/a", target: "http://localhost:8083"}
+  - {pattern: "/b", target: "http://localhost:8081"}
+`
+	if err := ioutil.WriteFile(m.path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := m.Config()
+	if cfg.RateLimit == nil {
+		t.Fatal("Expected the configuration file to be reloaded")
+	}
+	if a, _ := cfg.route("/a"); a.Target != "http://localhost:8083" {
+		t.Fatalf("Expected /a from the file, got %+v", a)
+	}
+	if _, ok := cfg.route("/b"); ok {
+		t.Fatal("Expected /b to stay deleted")
+	}
+	if _, ok := cfg.route("/c"); !ok {
+		t.Fatal("Expected /c to be kept")
+	}
+
+	api := httptest.NewServer(m.Proxy().ConfigAPI())
+	defer api.Close()
+	resp, err := http.Get(api.URL + "/routes/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "secret") {
+		t.Fatalf("Expected the header values to be redacted, got %s", body)
+	}
+}
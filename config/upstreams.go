@@ -0,0 +1,89 @@
+package config
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/breaker"
+	"github.com/zgiber/proxy/directors"
+)
+
+// upstreamState is the representation of an upstream
+// pool in the upstreams API.
+type upstreamState struct {
+	Policy  string        `json:"policy"`
+	Targets []targetState `json:"targets"`
+}
+
+type targetState struct {
+	URL         string `json:"url"`
+	Weight      int    `json:"weight"`
+	Outstanding int64  `json:"outstanding"`
+	directors.TargetHealth
+}
+
+// serveUpstreams is the handler of the upstreams API:
+//
+//	GET /upstreams         returns the state of all upstreams
+//	GET /upstreams/{name}  returns the state of an upstream
+func (m *Manager) serveUpstreams(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(rw, req, "GET")
+		return
+	}
+
+	current := m.current()
+
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/upstreams"), "/")
+	if name == "" {
+		states := map[string]upstreamState{}
+		for name, lb := range current.upstreams {
+			states[name] = newUpstreamState(current.cfg.Upstreams[name], lb)
+		}
+		writeJSON(rw, http.StatusOK, states)
+		return
+	}
+
+	lb, ok := current.upstreams[name]
+	if !ok {
+		proxy.WriteError(rw, req, directors.ErrNotFound("no such upstream"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, newUpstreamState(current.cfg.Upstreams[name], lb))
+}
+
+func newUpstreamState(upstream Upstream, lb *directors.LoadBalancer) upstreamState {
+	state := upstreamState{
+		Policy:  upstream.Policy,
+		Targets: []targetState{},
+	}
+	if state.Policy == "" {
+		state.Policy = directors.PolicyRoundRobin
+	}
+
+	for _, target := range lb.Targets() {
+		state.Targets = append(state.Targets, targetState{
+			URL:          target.URL.String(),
+			Weight:       target.Weight,
+			Outstanding:  target.Outstanding(),
+			TargetHealth: target.Health(),
+		})
+	}
+	return state
+}
+
+// serveCircuitBreakers returns the state of the circuit
+// breakers by upstream host on GET /circuit_breakers.
+func (m *Manager) serveCircuitBreakers(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(rw, req, "GET")
+		return
+	}
+
+	states := map[string]breaker.Snapshot{}
+	if breakers := m.current().breakers; breakers != nil {
+		states = breakers.Snapshots()
+	}
+	writeJSON(rw, http.StatusOK, states)
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zgiber/proxy/breaker"
+)
+
+func TestUpstreamsAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	m, cleanup := newTestManager(t, `
+listen: {proxy: ":9001"}
+upstreams:
+  pool:
+    targets: [{url: "`+upstream.URL+`"}]
+    health_check: {path: /health, interval: 10ms, unhealthy_threshold: 1}
+routes: [{pattern: /a, upstream: pool}]
+`)
+	defer cleanup()
+
+	api := httptest.NewServer(m.Proxy().ConfigAPI())
+	defer api.Close()
+
+	getState := func() upstreamState {
+		resp, err := http.Get(api.URL + "/upstreams/pool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		state := upstreamState{}
+		if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for state := getState(); state.Targets[0].Healthy; state = getState() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the target to become unhealthy: %+v", state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Proxy().ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/a", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 without healthy targets, got %v", rec.Code)
+	}
+
+	resp, err := http.Get(api.URL + "/upstreams/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown upstreams, got %v", resp.StatusCode)
+	}
+}
+
+func TestCircuitBreakersAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	m, cleanup := newTestManager(t, `
+listen: {proxy: ":9001"}
+circuit_breaker: {consecutive_failures: 1, open_timeout: 1m}
+routes: [{pattern: /a, target: "`+upstream.URL+`"}]
+`)
+	defer cleanup()
+
+	api := httptest.NewServer(m.Proxy().ConfigAPI())
+	defer api.Close()
+
+	m.Proxy().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/a", nil))
+
+	resp, err := http.Get(api.URL + "/circuit_breakers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	states := map[string]breaker.Snapshot{}
+	if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	if states[host].State != breaker.Open {
+		t.Fatalf("Expected the breaker of %s to be open, got %+v", host, states)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zgiber/proxy/auth"
+	"github.com/zgiber/proxy/directors"
+)
+
+// configAuth holds the authentication settings of the configuration API.
+type configAuth struct {
+	authenticators []auth.Authenticator
+	endpointRoles  map[string]auth.Role
+}
+
+// SetConfigAuth enables authentication on the configuration API.
+// Requests must be authenticated by one of the authenticators.
+// Safe methods (GET, HEAD, OPTIONS) require auth.RoleReadOnly, other
+// methods auth.RoleReadWrite. endpointRoles raises the required role
+// for paths under the given prefix (the longest prefix wins), it never
+// lowers the role required by the method.
+// Without authenticators the configuration API is open to anyone.
+// It is safe to call while the configuration API is served.
+func (rp *ReverseProxy) SetConfigAuth(authenticators []auth.Authenticator, endpointRoles map[string]auth.Role) {
+	rp.configAuth.Store(&configAuth{
+		authenticators: authenticators,
+		endpointRoles:  endpointRoles,
+	})
+}
+
+// serveConfig authenticates and authorizes the request before
+// passing it to the handlers of the configuration API. The
+// identity of the client is available for the handlers with
+// auth.IdentityFromRequest.
+func (rp *ReverseProxy) serveConfig(rw http.ResponseWriter, req *http.Request) {
+	ca, _ := rp.configAuth.Load().(*configAuth)
+	if ca == nil || len(ca.authenticators) == 0 {
+		rp.configAPI.ServeHTTP(rw, req)
+		return
+	}
+
+	identity, err := auth.Authenticate(req, ca.authenticators...)
+	if err != nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="config"`)
+		WriteError(rw, req, directors.ErrUnauthorized(err.Error()))
+		return
+	}
+
+	if !identity.Role.Allows(ca.requiredRole(req)) {
+		WriteError(rw, req, directors.ErrForbidden(string(identity.Role)+" role is not allowed to "+req.Method+" "+req.URL.Path))
+		return
+	}
+
+	rp.configAPI.ServeHTTP(rw, auth.WithIdentity(req, identity))
+}
+
+func (ca *configAuth) requiredRole(req *http.Request) auth.Role {
+	role := auth.RoleReadWrite
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		role = auth.RoleReadOnly
+	}
+
+	var longestPrefix string
+	var endpointRole auth.Role
+	for prefix, r := range ca.endpointRoles {
+		if underPrefix(req.URL.Path, prefix) && len(prefix) > len(longestPrefix) {
+			longestPrefix, endpointRole = prefix, r
+		}
+	}
+
+	if endpointRole == auth.RoleReadWrite {
+		return endpointRole
+	}
+	return role
+}
+
+// underPrefix reports whether path is prefix or a path below it,
+// "/routes" covers "/routes/a" but not "/routesX".
+func underPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zgiber/proxy/auth"
+)
+
+func TestConfigAuth(t *testing.T) {
+	rp := New()
+	rp.HandleConfig("/routes/", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if identity, ok := auth.IdentityFromRequest(req); !ok || identity.Name == "" {
+			t.Fatal("Identity is missing from the request")
+		}
+	}))
+	rp.HandleConfig("/reload", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	rp.HandleConfig("/reloads", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	rp.SetConfigAuth([]auth.Authenticator{
+		auth.NewBearerTokenAuthenticator(map[string]auth.Identity{
+			"reader-token": {Name: "reader", Role: auth.RoleReadOnly},
+			"writer-token": {Name: "writer", Role: auth.RoleReadWrite},
+		}),
+		auth.NewJWTAuthenticator("role"),
+	}, map[string]auth.Role{
+		"/reload":  auth.RoleReadWrite,
+		"/routes/": auth.RoleReadOnly,
+	})
+
+	jwtWriter, err := auth.NewJWT(map[string]interface{}{"sub": "ops", "role": "read-write"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{"GET", "/routes/a", "", http.StatusUnauthorized},
+		{"GET", "/routes/a", "invalid-token", http.StatusUnauthorized},
+		{"GET", "/routes/a", "reader-token", http.StatusOK},
+		{"PUT", "/routes/a", "reader-token", http.StatusForbidden},
+		{"PUT", "/routes/a", "writer-token", http.StatusOK},
+		{"GET", "/reload", "reader-token", http.StatusForbidden},
+		{"GET", "/reload", "writer-token", http.StatusOK},
+		{"GET", "/reloads", "reader-token", http.StatusOK},
+		{"DELETE", "/routes/a", "reader-token", http.StatusForbidden},
+		{"PUT", "/routes/a", jwtWriter, http.StatusOK},
+		{"PUT", "/routes/a", jwtWriter + "x", http.StatusUnauthorized},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost"+test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		rec := httptest.NewRecorder()
+		rp.ConfigAPI().ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedStatus {
+			t.Fatalf("[%v] Invalid status. Expected:%v Got:%v", i, test.expectedStatus, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package directors
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/zgiber/proxy/auth"
+)
+
+// NewJWTAuth returns a director which only lets requests through
+// with a valid JWT in the Authorization header ("Bearer <token>").
+// The claims of the token are stored in the request context
+// with the key "jwt.claims".
+func NewJWTAuth() func(req *http.Request) {
+	return newJWTAuth(auth.JWTClaims)
+}
+
+// NewJWTAuthWithKey is the same as NewJWTAuth, except that the
+// tokens are verified with key instead of auth.JWTPrivateKey.
+func NewJWTAuthWithKey(key string) func(req *http.Request) {
+	return newJWTAuth(func(token string) (map[string]interface{}, bool) {
+		return auth.JWTClaimsWithKey(token, key)
+	})
+}
+
+func newJWTAuth(verify func(token string) (map[string]interface{}, bool)) func(req *http.Request) {
+	return func(req *http.Request) {
+		token := auth.BearerToken(req)
+		if token == "" {
+			cancelRequestWithError(req, ErrUnauthorized("missing bearer token"))
+			return
+		}
+
+		claims, ok := verify(token)
+		if !ok {
+			cancelRequestWithError(req, ErrUnauthorized("invalid token"))
+			return
+		}
+
+		*req = *req.WithContext(context.WithValue(req.Context(), "jwt.claims", claims))
+	}
+}
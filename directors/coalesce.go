@@ -0,0 +1,76 @@
+package directors
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// CoalescePolicy enables the coalescing of concurrent identical GET
+// and HEAD requests of a route: while a request is in flight, the
+// transport of the ReverseProxy holds back the identical ones and
+// hands them a copy of its response, instead of sending them upstream.
+// Responses which can't be shared (e.g. private or setting cookies)
+// are not handed out, the held back requests are sent upstream then.
+type CoalescePolicy struct {
+	// Vary are the request headers which select the response
+	// besides the method and the URL (e.g. Accept-Encoding).
+	// Requests are identical if these headers are the same.
+	// Authorization and Cookie are always compared.
+	Vary []string
+
+	// MaxBodyBytes is the size of the largest response body
+	// which is shared (default 1MiB).
+	MaxBodyBytes int64
+}
+
+// NewCoalesce returns a director which applies the coalesce policy to
+// the request. It is meant to be used in the director chain of routes.
+func NewCoalesce(policy CoalescePolicy) func(req *http.Request) {
+	if policy.MaxBodyBytes <= 0 {
+		policy.MaxBodyBytes = 1 << 20
+	}
+
+	vary := []string{"Authorization", "Cookie"}
+	for _, name := range policy.Vary {
+		vary = append(vary, http.CanonicalHeaderKey(name))
+	}
+	policy.Vary = vary
+
+	return func(req *http.Request) {
+		*req = *req.WithContext(context.WithValue(req.Context(), "coalesce.policy", &policy))
+	}
+}
+
+// GetCoalescePolicy returns the CoalescePolicy of the request, if any.
+func GetCoalescePolicy(req *http.Request) (*CoalescePolicy, bool) {
+	policy, ok := req.Context().Value("coalesce.policy").(*CoalescePolicy)
+	return policy, ok
+}
+
+// Key returns the key which identical requests have in common. It
+// reports false if the request can't be coalesced: its method is not
+// GET or HEAD, it has a body, asks for a range, an upgrade or for
+// no-store.
+func (p *CoalescePolicy) Key(req *http.Request) (string, bool) {
+	switch {
+	case req.Method != "GET" && req.Method != "HEAD",
+		req.Body != nil && req.Body != http.NoBody,
+		req.Header.Get("Range") != "",
+		req.Header.Get("Upgrade") != "",
+		strings.Contains(strings.ToLower(req.Header.Get("Cache-Control")), "no-store"):
+		return "", false
+	}
+
+	// the targets of an upstream pool serve the same resources
+	resource := req.URL.String()
+	if route := GetRequestInfo(req).Route; route != "" {
+		resource = route + " " + req.URL.RequestURI()
+	}
+
+	key := req.Method + " " + req.Host + " " + resource
+	for _, name := range p.Vary {
+		key += "\n" + name + ": " + strings.Join(req.Header[name], ",")
+	}
+	return key, true
+}
@@ -0,0 +1,54 @@
+package directors
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	director := NewCoalesce(CoalescePolicy{Vary: []string{"accept-encoding"}})
+
+	key := func(method, url string, body string, header ...string) (string, bool) {
+		req := httptest.NewRequest(method, url, nil)
+		if body != "" {
+			req = httptest.NewRequest(method, url, strings.NewReader(body))
+		}
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		director(req)
+
+		policy, ok := GetCoalescePolicy(req)
+		if !ok {
+			t.Fatal("Expected a coalesce policy")
+		}
+		return policy.Key(req)
+	}
+
+	a, _ := key("GET", "http://localhost/a?b=c", "")
+	if b, _ := key("GET", "http://localhost/a?b=c", ""); a != b {
+		t.Fatalf("Expected identical requests to have the same key, got %q and %q", a, b)
+	}
+
+	for _, different := range [][]string{
+		{"HEAD", "http://localhost/a?b=c"},
+		{"GET", "http://localhost/a?b=d"},
+		{"GET", "http://localhost/a?b=c", "Accept-Encoding", "gzip"},
+		{"GET", "http://localhost/a?b=c", "Authorization", "Bearer token"},
+	} {
+		if b, _ := key(different[0], different[1], "", different[2:]...); a == b {
+			t.Fatalf("Expected %v to have a different key", different)
+		}
+	}
+
+	for _, excluded := range [][]string{
+		{"POST", "http://localhost/a", "body"},
+		{"GET", "http://localhost/a", "", "Range", "bytes=0-10"},
+		{"GET", "http://localhost/a", "", "Cache-Control", "no-store"},
+	} {
+		if _, ok := key(excluded[0], excluded[1], excluded[2], excluded[3:]...); ok {
+			t.Fatalf("Expected %v not to be coalesced", excluded)
+		}
+	}
+}
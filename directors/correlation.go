@@ -1,19 +1,177 @@
 package directors
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"regexp"
+	"time"
 
 	"github.com/zgiber/proxy/auth"
 )
 
+// Formats of generated correlation IDs.
+const (
+	CorrelationRandom = "random" // 16 random alphanumeric characters
+	CorrelationUUIDv4 = "uuidv4"
+	CorrelationUUIDv7 = "uuidv7" // time ordered UUID
+	CorrelationULID   = "ulid"   // time ordered, Crockford base32
+)
+
+// DefaultCorrelationHeader is the header carrying the correlation ID.
+const DefaultCorrelationHeader = "X-Correlation-ID"
+
+// defaultCorrelationPattern is the accepted format of incoming IDs
+// unless a pattern is configured.
+var defaultCorrelationPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// CorrelationOptions configure the correlation director.
+type CorrelationOptions struct {
+	// Header is the header carrying the ID (default X-Correlation-ID).
+	Header string
+
+	// TrustIncoming keeps the ID sent by the client if it's valid,
+	// i.e. it's not longer than MaxLength (default 128) and matches
+	// Pattern (default letters, digits and ._:-). Invalid IDs are
+	// replaced by a generated one.
+	TrustIncoming bool
+	MaxLength     int
+	Pattern       *regexp.Regexp
+
+	// Format of the generated IDs (default CorrelationRandom).
+	Format string
+
+	// Echo sets the ID on the response to the client.
+	Echo bool
+}
+
+// NewCorrelation returns a director which sets a new random
+// X-Correlation-ID on every request.
 func NewCorrelation() func(req *http.Request) {
+	director, _ := NewCorrelationWithOptions(CorrelationOptions{})
+	return director
+}
+
+// NewCorrelationWithOptions returns a director which sets the
+// correlation ID of the request, either the one sent by the client
+// or a generated one. The ID is stored in the request's context (see
+// CorrelationID) and RequestInfo for loggers and error responses.
+// Requests are rejected if an ID can't be generated.
+func NewCorrelationWithOptions(options CorrelationOptions) (func(req *http.Request), error) {
+	if options.Header == "" {
+		options.Header = DefaultCorrelationHeader
+	}
+	if options.MaxLength <= 0 {
+		options.MaxLength = 128
+	}
+	if options.Pattern == nil {
+		options.Pattern = defaultCorrelationPattern
+	}
+
+	generate, err := correlationGenerator(options.Format)
+	if err != nil {
+		return nil, err
+	}
 
 	return func(req *http.Request) {
-		token, err := auth.NewRandomTokenString(16)
-		if err != nil {
-			log.Println(err)
+		id := req.Header.Get(options.Header)
+		if !options.TrustIncoming || len(id) > options.MaxLength || !options.Pattern.MatchString(id) {
+			if id, err = generate(); err != nil {
+				cancelRequestWithError(req, NewProxyError(http.StatusInternalServerError, CodeInternal, "can't generate correlation ID"))
+				return
+			}
 		}
-		req.Header.Set("X-Correlation-ID", string(token))
+
+		req.Header.Set(options.Header, id)
+		*req = *req.WithContext(context.WithValue(req.Context(), "correlation.id", id))
+
+		info := GetRequestInfo(req)
+		info.CorrelationID = id
+		if options.Echo {
+			info.ResponseHeader.Set(options.Header, id)
+		}
+	}, nil
+}
+
+// CorrelationID returns the correlation ID of the request
+// set by the correlation director.
+func CorrelationID(req *http.Request) string {
+	if id, ok := req.Context().Value("correlation.id").(string); ok {
+		return id
+	}
+	return GetRequestInfo(req).CorrelationID
+}
+
+func correlationGenerator(format string) (func() (string, error), error) {
+	switch format {
+	case "", CorrelationRandom:
+		return func() (string, error) { return auth.NewRandomTokenString(16) }, nil
+	case CorrelationUUIDv4:
+		return newUUIDv4, nil
+	case CorrelationUUIDv7:
+		return newUUIDv7, nil
+	case CorrelationULID:
+		return newULID, nil
+	default:
+		return nil, fmt.Errorf("unknown correlation ID format %q", format)
+	}
+}
+
+func newUUIDv4() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	return formatUUID(u, 4), nil
+}
+
+// newUUIDv7 returns a UUID starting with the 48 bit
+// unix timestamp in milliseconds (RFC 9562).
+func newUUIDv7() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u[6:]); err != nil {
+		return "", err
+	}
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(u[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(u[2:6], uint32(ms))
+	return formatUUID(u, 7), nil
+}
+
+func formatUUID(u []byte, version byte) string {
+	u[6] = u[6]&0x0f | version<<4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+
+	s := hex.EncodeToString(u)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bit unix timestamp in milliseconds
+// followed by 80 random bits, encoded in 26 characters.
+func newULID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u[6:]); err != nil {
+		return "", err
+	}
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(u[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(u[2:6], uint32(ms))
+
+	// 128 bits are encoded in 26 characters of 5 bits,
+	// the first character holds the 3 highest bits
+	hi, lo := binary.BigEndian.Uint64(u[0:8]), binary.BigEndian.Uint64(u[8:16])
+	id := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
 	}
+	return string(id), nil
 }
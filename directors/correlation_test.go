@@ -0,0 +1,72 @@
+package directors
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestCorrelationFormats(t *testing.T) {
+	tt := []struct {
+		format  string
+		pattern *regexp.Regexp
+	}{
+		{CorrelationRandom, regexp.MustCompile(`^[A-Za-z0-9]{16}$`)},
+		{CorrelationUUIDv4, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{CorrelationUUIDv7, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{CorrelationULID, regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+	}
+
+	for _, tc := range tt {
+		director, err := NewCorrelationWithOptions(CorrelationOptions{Format: tc.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set(DefaultCorrelationHeader, "ignored")
+		director(req)
+
+		id := req.Header.Get(DefaultCorrelationHeader)
+		if !tc.pattern.MatchString(id) || CorrelationID(req) != id {
+			t.Errorf("%s: invalid ID %q", tc.format, id)
+		}
+	}
+
+	if _, err := NewCorrelationWithOptions(CorrelationOptions{Format: "uuidv1"}); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestCorrelationTrustIncoming(t *testing.T) {
+	director, err := NewCorrelationWithOptions(CorrelationOptions{
+		TrustIncoming: true,
+		MaxLength:     12,
+		Format:        CorrelationUUIDv4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		incoming string
+		kept     bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"abcdefghijklm", false},
+		{"abc 123", false},
+		{"abc\n123", false},
+	}
+
+	for _, tc := range tt {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set(DefaultCorrelationHeader, tc.incoming)
+		director(req)
+
+		id := CorrelationID(req)
+		if kept := id == tc.incoming; kept != tc.kept || len(id) == 0 {
+			t.Errorf("%q: expected kept:%v, got ID %q", tc.incoming, tc.kept, id)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package directors
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy configures Cross-Origin Resource Sharing for the requests
+// of a route. Preflight requests are answered by the proxy, the other
+// requests from allowed origins are sent upstream and their responses
+// get the Access-Control-Allow-* headers.
+type CORSPolicy struct {
+	// AllowedOrigins are the origins which may access the route, e.g.
+	// "https://example.com". "*" allows any origin (but not together with
+	// AllowCredentials), a "*" in an origin matches any part of a host
+	// name or a port, e.g. "https://*.example.com".
+	AllowedOrigins []string
+
+	// AllowedMethods are the methods allowed in preflight
+	// requests (default GET, HEAD and POST).
+	AllowedMethods []string
+
+	// AllowedHeaders are the request headers allowed in
+	// preflight requests, "*" allows any header.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers which
+	// scripts are allowed to read.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with cookies or
+	// authorization headers.
+	AllowCredentials bool
+
+	// MaxAge is the time browsers may cache the result
+	// of a preflight request, 0 leaves it to them.
+	MaxAge time.Duration
+}
+
+type cors struct {
+	policy    CORSPolicy
+	anyOrigin bool
+	origins   []*regexp.Regexp
+	methods   string
+	anyHeader bool
+	headers   map[string]bool
+}
+
+// NewCORS returns a director which applies the CORS policy to the
+// request. It is meant to be used in the director chain of routes,
+// before directors which authenticate the client, as preflight
+// requests don't carry credentials. It returns an error if any
+// origin is allowed with credentials, which would let any site
+// make requests on behalf of the users.
+func NewCORS(policy CORSPolicy) (func(req *http.Request), error) {
+	if len(policy.AllowedMethods) == 0 {
+		policy.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	}
+
+	c := &cors{policy: policy, headers: map[string]bool{}}
+	for _, origin := range policy.AllowedOrigins {
+		if origin == "*" {
+			if policy.AllowCredentials {
+				return nil, errors.New(`allowed origin "*" is not allowed with credentials`)
+			}
+			c.anyOrigin = true
+			continue
+		}
+		pattern := strings.Replace(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9.-]+`, -1)
+		c.origins = append(c.origins, regexp.MustCompile("^"+pattern+"$"))
+	}
+
+	methods := []string{}
+	for _, method := range policy.AllowedMethods {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	c.policy.AllowedMethods = methods
+	c.methods = strings.Join(methods, ", ")
+
+	for _, header := range policy.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+		}
+		c.headers[strings.ToLower(header)] = true
+	}
+
+	return c.direct, nil
+}
+
+func (c *cors) direct(req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		// not a cross-origin request
+		return
+	}
+
+	info := GetRequestInfo(req)
+	if req.Method != "OPTIONS" || req.Header.Get("Access-Control-Request-Method") == "" {
+		if !c.anyOrigin {
+			info.ResponseHeader.Add("Vary", "Origin")
+		}
+		if c.allowOrigin(origin) {
+			c.setHeaders(info.ResponseHeader, origin)
+			if len(c.policy.ExposedHeaders) > 0 {
+				info.ResponseHeader.Set("Access-Control-Expose-Headers", strings.Join(c.policy.ExposedHeaders, ", "))
+			}
+		}
+		return
+	}
+
+	// the preflight request is answered by the proxy
+	info.ResponseHeader.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	requestedHeaders := req.Header.Get("Access-Control-Request-Headers")
+	switch {
+	case !c.allowOrigin(origin):
+		cancelRequestWithError(req, ErrForbidden("origin is not allowed"))
+		return
+	case !c.allowMethod(req.Header.Get("Access-Control-Request-Method")):
+		cancelRequestWithError(req, ErrForbidden("method is not allowed"))
+		return
+	case !c.allowHeaders(requestedHeaders):
+		cancelRequestWithError(req, ErrForbidden("headers are not allowed"))
+		return
+	}
+
+	header := http.Header{}
+	c.setHeaders(header, origin)
+	header.Set("Access-Control-Allow-Methods", c.methods)
+	if requestedHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", requestedHeaders)
+	}
+	if c.policy.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.FormatInt(int64(c.policy.MaxAge/time.Second), 10))
+	}
+	Respond(req, http.StatusNoContent, header)
+}
+
+// setHeaders sets the headers of the responses to
+// requests from an allowed origin.
+func (c *cors) setHeaders(header http.Header, origin string) {
+	if c.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.policy.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *cors) allowOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range c.origins {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) allowMethod(method string) bool {
+	for _, allowed := range c.policy.AllowedMethods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders reports whether the headers of the
+// Access-Control-Request-Headers list are allowed.
+func (c *cors) allowHeaders(requested string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" && !c.headers[header] {
+			return false
+		}
+	}
+	return true
+}
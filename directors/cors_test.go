@@ -0,0 +1,113 @@
+package directors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	director, err := NewCORS(CORSPolicy{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Authorization"},
+		MaxAge:         time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preflight := func(origin, method, headers string) *http.Request {
+		req := httptest.NewRequest("OPTIONS", "http://localhost/", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", headers)
+		director(req)
+		return req
+	}
+
+	req := preflight("https://app.example.com", "PUT", "authorization")
+	resp, ok := req.Context().Value("response").(*http.Response)
+	if !ok || resp.StatusCode != http.StatusNoContent {
+		t.Fatal("Expected the preflight request to be answered")
+	}
+	for header, expected := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "authorization",
+		"Access-Control-Max-Age":       "60",
+	} {
+		if value := resp.Header.Get(header); value != expected {
+			t.Fatalf("Expected %s: %s, got %q", header, expected, value)
+		}
+	}
+
+	for _, rejected := range [][]string{
+		{"https://example.org", "PUT", ""},
+		{"https://evil.com/.example.com", "PUT", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "PUT", "X-Custom"},
+	} {
+		req := preflight(rejected[0], rejected[1], rejected[2])
+		if pe, ok := req.Context().Value("error").(*ProxyError); !ok || pe.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected %v to be forbidden", rejected)
+		}
+	}
+}
+
+func TestCORSResponseHeaders(t *testing.T) {
+	director, err := NewCORS(CORSPolicy{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Total-Count"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	info := NewRequestInfo(req)
+	req = WithRequestInfo(req, info)
+	director(req)
+
+	if req.Context().Err() != nil {
+		t.Fatal("Expected the request to be sent upstream")
+	}
+	for header, expected := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    "X-Total-Count",
+		"Vary":                             "Origin",
+	} {
+		if value := info.ResponseHeader.Get(header); value != expected {
+			t.Fatalf("Expected %s: %s, got %q", header, expected, value)
+		}
+	}
+}
+
+func TestCORSAnyOriginWithCredentials(t *testing.T) {
+	// any site could make requests on behalf of the users
+	if _, err := NewCORS(CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}); err == nil {
+		t.Fatal("Expected an error for any origin with credentials")
+	}
+
+	director, err := NewCORS(CORSPolicy{AllowedOrigins: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	info := NewRequestInfo(req)
+	req = WithRequestInfo(req, info)
+	director(req)
+
+	if origin := info.ResponseHeader.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Fatalf("Expected Access-Control-Allow-Origin: *, got %q", origin)
+	}
+	if credentials := info.ResponseHeader.Get("Access-Control-Allow-Credentials"); credentials != "" {
+		t.Fatalf("Expected no credentials, got %q", credentials)
+	}
+}
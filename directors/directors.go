@@ -1,7 +1,6 @@
 package directors
 
 import (
-	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -13,7 +12,6 @@ import (
 // Empty values on the target are ignored.
 func rewriteRequest(target *url.URL, req *http.Request) {
 	if target.Scheme != "" {
-		// fmt.Println(target.Scheme)
 		req.URL.Scheme = target.Scheme
 	}
 
@@ -31,8 +29,7 @@ func rewriteRequest(target *url.URL, req *http.Request) {
 		req.Header.Set("User-Agent", "")
 	}
 
-	fmt.Println("target Scheme", target.Scheme)
-	fmt.Println("request Scheme", req.URL.Scheme)
+	GetRequestInfo(req).Upstream = req.URL.Host
 }
 
 // rewriteRequestPath changes the request's path to the target path.
@@ -0,0 +1,103 @@
+package directors
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Machine readable error codes used by the directors in this package.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeNotFound           = "not_found"
+	CodeInvalidTarget      = "invalid_target"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeServiceUnavailable = "service_unavailable"
+	CodeBadGateway         = "bad_gateway"
+	CodeGatewayTimeout     = "gateway_timeout"
+	CodeInternal           = "internal_error"
+	CodeCircuitOpen        = "circuit_open"
+	CodeClientClosed       = "client_closed_request"
+)
+
+// ProxyError is an error which carries enough information to
+// be rendered as a proper http response to the client.
+// Directors attach it to the request with CancelRequestWithError.
+type ProxyError struct {
+	StatusCode    int
+	Code          string
+	Message       string
+	CorrelationID string
+
+	// RetryAfter is sent in the Retry-After header if it's set.
+	RetryAfter time.Duration
+}
+
+// NewProxyError returns a ProxyError with the given status code,
+// machine readable code and human readable message.
+func NewProxyError(statusCode int, code, message string) *ProxyError {
+	return &ProxyError{
+		StatusCode: statusCode,
+		Code:       code,
+		Message:    message,
+	}
+}
+
+func (pe *ProxyError) Error() string {
+	return fmt.Sprintf("%d %s: %s", pe.StatusCode, pe.Code, pe.Message)
+}
+
+// ErrBadRequest returns a ProxyError for invalid requests.
+func ErrBadRequest(message string) *ProxyError {
+	return NewProxyError(http.StatusBadRequest, CodeBadRequest, message)
+}
+
+// ErrNotFound returns a ProxyError for requests without a matching route.
+func ErrNotFound(message string) *ProxyError {
+	return NewProxyError(http.StatusNotFound, CodeNotFound, message)
+}
+
+// ErrUnauthorized returns a ProxyError for unauthenticated requests.
+func ErrUnauthorized(message string) *ProxyError {
+	return NewProxyError(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+// ErrForbidden returns a ProxyError for requests which are authenticated
+// but not allowed to access the resource.
+func ErrForbidden(message string) *ProxyError {
+	return NewProxyError(http.StatusForbidden, CodeForbidden, message)
+}
+
+// ErrTooManyRequests returns a ProxyError for rate limited requests.
+func ErrTooManyRequests(message string) *ProxyError {
+	return NewProxyError(http.StatusTooManyRequests, CodeTooManyRequests, message)
+}
+
+// ErrServiceUnavailable returns a ProxyError for requests which can not
+// be served because the upstream is unavailable.
+func ErrServiceUnavailable(message string) *ProxyError {
+	return NewProxyError(http.StatusServiceUnavailable, CodeServiceUnavailable, message)
+}
+
+// ErrGatewayTimeout returns a ProxyError for requests which
+// timed out waiting for the upstream.
+func ErrGatewayTimeout(message string) *ProxyError {
+	return NewProxyError(http.StatusGatewayTimeout, CodeGatewayTimeout, message)
+}
+
+// CancelRequestWithError cancels the request's context and stores err
+// on it. The chained directors stop processing the request and the
+// error is returned by the RoundTripper instead of calling the upstream.
+func CancelRequestWithError(req *http.Request, err error) {
+	cancelRequestWithError(req, err)
+}
+
+func cancelRequestWithError(req *http.Request, err error) {
+	ctx := context.WithValue(req.Context(), "error", err)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	*req = *req.WithContext(ctx)
+}
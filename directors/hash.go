@@ -0,0 +1,237 @@
+package directors
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PolicyConsistentHash is the name of the consistent hashing policy.
+// It requires a HashKey, see ConsistentHash.
+const PolicyConsistentHash = "consistent_hash"
+
+// replicas is the number of points of a target with
+// weight 1 on the hash ring.
+const replicas = 160
+
+// HashKey returns the key of a request for consistent hashing.
+type HashKey func(req *http.Request) string
+
+// HashByPathVariable uses the value of a path variable
+// of the matched route (e.g. "user_id" for ":user_id").
+func HashByPathVariable(name string) HashKey {
+	return func(req *http.Request) string {
+		return PathVariable(req, name)
+	}
+}
+
+// HashByHeader uses the value of a request header.
+func HashByHeader(name string) HashKey {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// HashByCookie uses the value of a cookie.
+func HashByCookie(name string) HashKey {
+	return func(req *http.Request) string {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// HashByClientIP uses the IP address of the client.
+func HashByClientIP() HashKey {
+	return func(req *http.Request) string {
+		if clientIP := GetRequestInfo(req).ClientIP; clientIP != "" {
+			return clientIP
+		}
+
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return clientIP
+	}
+}
+
+// ParseHashKey returns the HashKey described by s:
+//
+//	path:user_id      the path variable ":user_id"
+//	header:X-User-ID  a request header
+//	cookie:session    a cookie
+//	client_ip         the IP address of the client
+func ParseHashKey(s string) (HashKey, error) {
+	if s == "client_ip" {
+		return HashByClientIP(), nil
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid hash key %q", s)
+	}
+
+	switch parts[0] {
+	case "path":
+		return HashByPathVariable(parts[1]), nil
+	case "header":
+		return HashByHeader(parts[1]), nil
+	case "cookie":
+		return HashByCookie(parts[1]), nil
+	default:
+		return nil, fmt.Errorf("invalid hash key %q", s)
+	}
+}
+
+// ConsistentHash returns a Policy which sends requests with the
+// same key to the same target using a hash ring. The points of a
+// target on the ring are derived from its URL and their number
+// from its weight, so when targets are added or removed only the
+// keys of those targets are remapped. The ring covers all targets
+// of the LoadBalancer, keys of unavailable targets go to the next
+// available target on the ring and return once it recovers.
+// Requests without a key are sent to a random target.
+func ConsistentHash(key HashKey) Policy {
+	return &consistentHash{key: key}
+}
+
+type consistentHash struct {
+	key HashKey
+
+	mu   sync.Mutex
+	ring *hashRing
+}
+
+func (p *consistentHash) Pick(targets []*Target, req *http.Request) *Target {
+	return p.pick(targets, req, nil)
+}
+
+// pick returns the target of the key of req, skipping except and
+// the targets of the ring which are not in targets. It returns nil
+// if there's no other target than except.
+func (p *consistentHash) pick(targets []*Target, req *http.Request, except *Target) *Target {
+	k := p.key(req)
+	if k == "" {
+		if except == nil {
+			return randomTarget(targets)
+		}
+		others := []*Target{}
+		for _, target := range targets {
+			if target != except {
+				others = append(others, target)
+			}
+		}
+		if len(others) == 0 {
+			return nil
+		}
+		return randomTarget(others)
+	}
+
+	all := targets
+	if pool := targets[0].pool; pool != nil {
+		pool.RLock()
+		all = pool.targets
+		pool.RUnlock()
+	}
+
+	p.mu.Lock()
+	if p.ring == nil || !p.ring.builtFor(all) {
+		p.ring = newHashRing(all)
+	}
+	ring := p.ring
+	p.mu.Unlock()
+
+	target := ring.lookup(hash(k), func(target *Target) bool {
+		return target != except && containsTarget(targets, target)
+	})
+	if target == nil && except == nil {
+		// the targets of the pool were replaced meanwhile
+		return randomTarget(targets)
+	}
+	return target
+}
+
+// hashRing maps hashes to targets.
+type hashRing struct {
+	all     []*Target // the targets the ring is built for
+	points  []uint64
+	targets map[uint64]*Target
+}
+
+func newHashRing(all []*Target) *hashRing {
+	ring := &hashRing{
+		all:     all,
+		targets: map[uint64]*Target{},
+	}
+
+	for _, target := range all {
+		for r := 0; r < replicas*target.Weight; r++ {
+			point := hash(target.URL.String() + "#" + strconv.Itoa(r))
+			if _, taken := ring.targets[point]; taken {
+				continue
+			}
+			ring.targets[point] = target
+			ring.points = append(ring.points, point)
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// lookup returns the first target of the ring at or after h
+// which can be used. It returns nil if none of them can.
+func (ring *hashRing) lookup(h uint64, usable func(*Target) bool) *Target {
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	for n := 0; n < len(ring.points); n++ {
+		target := ring.targets[ring.points[(start+n)%len(ring.points)]]
+		if usable(target) {
+			return target
+		}
+	}
+	return nil
+}
+
+func (ring *hashRing) builtFor(all []*Target) bool {
+	if len(all) != len(ring.all) {
+		return false
+	}
+	for i := range all {
+		if all[i] != ring.all[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsTarget(targets []*Target, target *Target) bool {
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// hash is FNV-1a with a final mix, so similar
+// keys are spread evenly on the ring.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
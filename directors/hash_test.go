@@ -0,0 +1,130 @@
+package directors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConsistentHash(t *testing.T) {
+	targets := testTargets(1, 1, 1, 1)
+	policy := ConsistentHash(HashByHeader("X-User-ID"))
+
+	pick := func(targets []*Target, key string) string {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("X-User-ID", key)
+		return policy.Pick(targets, req).URL.Host
+	}
+
+	before := map[string]string{}
+	hosts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := "user" + strconv.Itoa(i)
+		before[key] = pick(targets, key)
+		hosts[before[key]]++
+
+		if pick(targets, key) != before[key] {
+			t.Fatalf("Expected %v to be sent to the same target", key)
+		}
+	}
+
+	for host, n := range hosts {
+		if n < 150 || n > 350 {
+			t.Fatalf("Uneven distribution, %v got %v of 1000", host, n)
+		}
+	}
+
+	// remove a target, only its keys are remapped
+	removed := targets[1].URL.Host
+	for key, host := range before {
+		after := pick([]*Target{targets[0], targets[2], targets[3]}, key)
+		if host != removed && after != host {
+			t.Fatalf("Expected %v to stay on %v, got %v", key, host, after)
+		}
+	}
+
+	// the same URLs result in the same mapping
+	for key, host := range before {
+		if after := pick(testTargets(1, 1, 1, 1), key); after != host {
+			t.Fatalf("Expected %v to be restored on %v, got %v", key, host, after)
+		}
+	}
+}
+
+func TestConsistentHashPathVariable(t *testing.T) {
+	lb := NewLoadBalancer(testTargets(1, 1, 1), ConsistentHash(HashByPathVariable("user_id")))
+	router := NewRouter(map[string]func(*http.Request){
+		"/users/:user_id":         lb.Direct,
+		"/users/:user_id/profile": lb.Direct,
+	})
+
+	hosts := map[string]bool{}
+	for _, path := range []string{"/users/user123", "/users/user123/profile"} {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		router(req)
+		hosts[req.URL.Host] = true
+	}
+
+	if len(hosts) != 1 {
+		t.Fatalf("Expected the same target for the same user, got %v", hosts)
+	}
+}
+
+func TestParseHashKey(t *testing.T) {
+	for _, s := range []string{"path:user_id", "header:X-User-ID", "cookie:session", "client_ip"} {
+		if _, err := ParseHashKey(s); err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+	}
+
+	for _, s := range []string{"", "path:", "query:id", "client"} {
+		if _, err := ParseHashKey(s); err == nil {
+			t.Fatalf("%v: expected an error", s)
+		}
+	}
+}
+
+func TestConsistentHashUnavailable(t *testing.T) {
+	targets := testTargets(1, 1, 1, 1)
+	lb := NewLoadBalancer(targets, ConsistentHash(HashByHeader("X-User-ID")))
+
+	direct := func(key string) (*http.Request, *Target) {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("X-User-ID", key)
+		req = WithRequestInfo(req, NewRequestInfo(req))
+		lb.Direct(req)
+		target, _ := UpstreamTarget(req)
+		return req, target
+	}
+
+	before := map[string]*Target{}
+	for i := 0; i < 200; i++ {
+		key := "user" + strconv.Itoa(i)
+		_, before[key] = direct(key)
+	}
+
+	// only the keys of the ejected target move, and they come back
+	ejected := targets[1]
+	ejected.outlier.ejectedUntil = time.Now().Add(time.Minute)
+	for key, target := range before {
+		req, after := direct(key)
+		if after == ejected || target != ejected && after != target {
+			t.Fatalf("Expected %v to stay on %v, got %v", key, target.URL.Host, after.URL.Host)
+		}
+
+		// hedged requests go to the next target on the ring
+		hedged, ok := Hedge(req)
+		if hedgedTarget, _ := UpstreamTarget(hedged); !ok || hedgedTarget == after || hedgedTarget == ejected {
+			t.Fatalf("Expected %v to be hedged to another available target", key)
+		}
+	}
+
+	ejected.outlier.ejectedUntil = time.Time{}
+	for key, target := range before {
+		if _, after := direct(key); after != target {
+			t.Fatalf("Expected %v to return to %v, got %v", key, target.URL.Host, after.URL.Host)
+		}
+	}
+}
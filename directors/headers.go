@@ -0,0 +1,208 @@
+package directors
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HeaderRules change the headers of requests or responses. They are
+// applied in order: Remove, Rename, Set and Add. Set replaces the
+// values of a header, it removes the header if the value is empty
+// (e.g. a missing JWT claim), so clients can't supply it instead.
+//
+// Values of Set and Add are templates with variables in "${...}":
+//
+//	${path.user_id}    the path variable :user_id of the route
+//	${correlation_id}  the correlation ID of the request
+//	${client_ip}       the IP address of the client
+//	${jwt.sub}         the claim "sub" of the JWT (see NewJWTAuth)
+//	${env.REGION}      the environment variable REGION
+//
+// Environment variables are read when the director is created.
+type HeaderRules struct {
+	Remove []string
+	Rename []HeaderRename // applied in order, so renames can be chained
+	Set    map[string]string
+	Add    map[string]string
+}
+
+// HeaderRename renames the header From to To.
+type HeaderRename struct {
+	From string
+	To   string
+}
+
+type headerRules struct {
+	remove []string
+	rename []HeaderRename
+	set    map[string]template
+	add    map[string]template
+}
+
+// NewHeaders returns a director which applies the request rules to the
+// request sent upstream and the response rules to the response to the
+// client, whether it comes from the upstream or it's an error. It is
+// meant to be used in the director chain of routes after the
+// directors providing the variables, e.g. NewJWTAuth. It returns
+// an error if a template is invalid.
+func NewHeaders(request, response HeaderRules) (func(req *http.Request), error) {
+	requestRules, err := compileHeaderRules(request)
+	if err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+	responseRules, err := compileHeaderRules(response)
+	if err != nil {
+		return nil, fmt.Errorf("response: %v", err)
+	}
+
+	return func(req *http.Request) {
+		requestRules.apply(req.Header, req)
+
+		if !responseRules.empty() {
+			GetRequestInfo(req).OnResponseHeader(func(header http.Header) {
+				responseRules.apply(header, req)
+			})
+		}
+	}, nil
+}
+
+func compileHeaderRules(rules HeaderRules) (*headerRules, error) {
+	compiled := &headerRules{
+		remove: rules.Remove,
+		rename: rules.Rename,
+		set:    map[string]template{},
+		add:    map[string]template{},
+	}
+
+	for name, value := range rules.Set {
+		t, err := parseTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		compiled.set[name] = t
+	}
+	for name, value := range rules.Add {
+		t, err := parseTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		compiled.add[name] = t
+	}
+	return compiled, nil
+}
+
+func (rules *headerRules) empty() bool {
+	return len(rules.remove) == 0 && len(rules.rename) == 0 && len(rules.set) == 0 && len(rules.add) == 0
+}
+
+// apply changes the header, variables are taken from req.
+func (rules *headerRules) apply(header http.Header, req *http.Request) {
+	for _, name := range rules.remove {
+		header.Del(name)
+	}
+
+	for _, rename := range rules.rename {
+		values := header.Values(rename.From)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(rename.From)
+		header[http.CanonicalHeaderKey(rename.To)] = values
+	}
+
+	for name, t := range rules.set {
+		if value := t.render(req); value != "" {
+			header.Set(name, value)
+		} else {
+			header.Del(name)
+		}
+	}
+
+	for name, t := range rules.add {
+		if value := t.render(req); value != "" {
+			header.Add(name, value)
+		}
+	}
+}
+
+// template is a header value with variables, a list of
+// literals and variables which are rendered in order.
+type template []func(req *http.Request) string
+
+func parseTemplate(s string) (template, error) {
+	t := template{}
+	for s != "" {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			t = append(t, literal(s))
+			break
+		}
+		if start > 0 {
+			t = append(t, literal(s[:start]))
+		}
+
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed variable in %q", s)
+		}
+		variable, err := templateVariable(s[start+2 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, variable)
+		s = s[start+end+1:]
+	}
+	return t, nil
+}
+
+func literal(s string) func(*http.Request) string {
+	return func(*http.Request) string { return s }
+}
+
+func templateVariable(name string) (func(*http.Request) string, error) {
+	switch {
+	case name == "correlation_id":
+		return CorrelationID, nil
+	case name == "client_ip":
+		return func(req *http.Request) string { return GetRequestInfo(req).ClientIP }, nil
+	case strings.HasPrefix(name, "path.") && len(name) > len("path."):
+		key := name[len("path."):]
+		return func(req *http.Request) string { return PathVariable(req, key) }, nil
+	case strings.HasPrefix(name, "jwt.") && len(name) > len("jwt."):
+		claim := name[len("jwt."):]
+		return func(req *http.Request) string { return jwtClaim(req, claim) }, nil
+	case strings.HasPrefix(name, "env.") && len(name) > len("env."):
+		return literal(os.Getenv(name[len("env."):])), nil
+	}
+	return nil, fmt.Errorf("unknown variable %q", name)
+}
+
+// jwtClaim returns the claim of the JWT verified by NewJWTAuth.
+func jwtClaim(req *http.Request, claim string) string {
+	claims, _ := req.Context().Value("jwt.claims").(map[string]interface{})
+	switch value := claims[claim].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func (t template) render(req *http.Request) string {
+	if len(t) == 1 {
+		return t[0](req)
+	}
+
+	var b strings.Builder
+	for _, part := range t {
+		b.WriteString(part(req))
+	}
+	return b.String()
+}
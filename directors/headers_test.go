@@ -0,0 +1,78 @@
+package directors
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	os.Setenv("PROXY_TEST_REGION", "eu")
+	defer os.Unsetenv("PROXY_TEST_REGION")
+
+	director, err := NewHeaders(HeaderRules{
+		Remove: []string{"X-Debug"},
+		Rename: []HeaderRename{{From: "X-Old", To: "X-Older"}, {From: "X-Older", To: "X-New"}},
+		Set: map[string]string{
+			"X-User":   "${path.user_id}@${env.PROXY_TEST_REGION}",
+			"X-Client": "${client_ip}",
+			"X-Sub":    "${jwt.sub}",
+			"X-Role":   "${jwt.role}",
+		},
+		Add: map[string]string{"X-Tags": "proxy"},
+	}, HeaderRules{
+		Remove: []string{"Server", "X-Powered-By"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-Old", "value")
+	req.Header.Set("X-Role", "admin")
+	req.Header.Set("X-Tags", "client")
+
+	info := NewRequestInfo(req)
+	req = WithRequestInfo(req, info)
+	ctx := context.WithValue(req.Context(), "user_id", "42")
+	ctx = context.WithValue(ctx, "jwt.claims", map[string]interface{}{"sub": "user"})
+	req = req.WithContext(ctx)
+
+	director(req)
+
+	for name, expected := range map[string]string{
+		"X-Debug":  "",
+		"X-Old":    "",
+		"X-Older":  "",
+		"X-New":    "value",
+		"X-User":   "42@eu",
+		"X-Client": info.ClientIP,
+		"X-Sub":    "user",
+		// missing claims don't let the client set the header
+		"X-Role": "",
+	} {
+		if value := req.Header.Get(name); value != expected {
+			t.Fatalf("Expected %s: %q, got %q", name, expected, value)
+		}
+	}
+	if tags := req.Header.Values("X-Tags"); len(tags) != 2 {
+		t.Fatalf("Expected the value to be added, got %v", tags)
+	}
+
+	header := http.Header{"Server": {"nginx"}, "X-Powered-By": {"PHP"}, "Content-Type": {"text/plain"}}
+	info.WriteResponseHeader(header)
+	if len(header) != 1 {
+		t.Fatalf("Expected the upstream headers to be removed, got %v", header)
+	}
+}
+
+func TestHeaderTemplates(t *testing.T) {
+	for _, invalid := range []string{"${unknown}", "${path.}", "${jwt.sub"} {
+		if _, err := NewHeaders(HeaderRules{Set: map[string]string{"X-A": invalid}}, HeaderRules{}); err == nil {
+			t.Fatalf("Expected %q to be invalid", invalid)
+		}
+	}
+}
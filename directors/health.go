@@ -0,0 +1,197 @@
+package directors
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures active health checking of the targets
+// of a LoadBalancer.
+type HealthCheck struct {
+	// Path is requested on the scheme and host of every target.
+	Path string
+
+	// ExpectedStatus is the status code of a healthy target,
+	// any 2xx status is accepted if it's 0.
+	ExpectedStatus int
+
+	// Interval between checks (default 10s) and Timeout of
+	// a single check (default 2s).
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// A target becomes healthy after HealthyThreshold successful
+	// checks in a row (default 2), and unhealthy after
+	// UnhealthyThreshold failed checks in a row (default 3).
+	HealthyThreshold   int
+	UnhealthyThreshold int
+
+	// Client sends the checks (default a client with Timeout).
+	Client *http.Client
+}
+
+// TargetHealth is the health state of a Target, from
+// health checks and outlier detection.
+type TargetHealth struct {
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until"`
+	Ejections    int       `json:"ejections"` // in a row
+}
+
+// targetHealth is the health state kept by a Target.
+type targetHealth struct {
+	sync.Mutex
+	unhealthy bool
+	lastCheck time.Time
+	lastError string
+	successes int // in a row
+	failures  int // in a row
+}
+
+// Health returns the health state of the target.
+// Targets are healthy until checked otherwise.
+func (t *Target) Health() TargetHealth {
+	t.health.Lock()
+	health := TargetHealth{
+		Healthy:   !t.health.unhealthy,
+		LastCheck: t.health.lastCheck,
+		LastError: t.health.lastError,
+	}
+	t.health.Unlock()
+
+	t.outlier.Lock()
+	health.EjectedUntil = t.outlier.ejectedUntil
+	health.Ejections = t.outlier.ejections
+	t.outlier.Unlock()
+
+	health.Ejected = time.Now().Before(health.EjectedUntil)
+	return health
+}
+
+// Healthy reports whether the target passes its health checks.
+func (t *Target) Healthy() bool {
+	t.health.Lock()
+	defer t.health.Unlock()
+
+	return !t.health.unhealthy
+}
+
+// CheckHealth starts checking the health of the targets in the
+// background until Close is called. Unhealthy targets don't
+// receive requests from the LoadBalancer.
+func (lb *LoadBalancer) CheckHealth(hc HealthCheck) {
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	if hc.Client == nil {
+		hc.Client = &http.Client{Timeout: hc.Timeout}
+	}
+
+	lb.Lock()
+	if lb.stop == nil {
+		lb.stop = make(chan struct{})
+	}
+	stop := lb.stop
+	lb.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+
+		for {
+			lb.checkTargets(hc)
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the health checks of the LoadBalancer.
+func (lb *LoadBalancer) Close() {
+	lb.Lock()
+	defer lb.Unlock()
+
+	if lb.stop != nil {
+		close(lb.stop)
+		lb.stop = nil
+	}
+}
+
+// checkTargets checks all targets concurrently.
+func (lb *LoadBalancer) checkTargets(hc HealthCheck) {
+	wg := sync.WaitGroup{}
+	for _, target := range lb.Targets() {
+		wg.Add(1)
+		go func(target *Target) {
+			defer wg.Done()
+			target.recordCheck(hc, checkTarget(target, hc))
+		}(target)
+	}
+	wg.Wait()
+}
+
+func checkTarget(target *Target, hc HealthCheck) error {
+	u := *target.URL
+	u.Path, u.RawPath, u.RawQuery = hc.Path, "", ""
+
+	resp, err := hc.Client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if hc.ExpectedStatus == 0 && resp.StatusCode/100 == 2 || resp.StatusCode == hc.ExpectedStatus {
+		return nil
+	}
+	return fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// recordCheck updates the health state with the result of a check.
+func (t *Target) recordCheck(hc HealthCheck, err error) {
+	h := &t.health
+	h.Lock()
+	defer h.Unlock()
+
+	h.lastCheck = time.Now().UTC()
+	if err != nil {
+		h.lastError = err.Error()
+		h.successes = 0
+		h.failures++
+		if !h.unhealthy && h.failures >= hc.UnhealthyThreshold {
+			h.unhealthy = true
+			log.Printf("upstream target %s is unhealthy: %v", t.URL, err)
+		}
+		return
+	}
+
+	h.lastError = ""
+	h.failures = 0
+	h.successes++
+	if h.unhealthy && h.successes >= hc.HealthyThreshold {
+		h.unhealthy = false
+		log.Printf("upstream target %s is healthy", t.URL)
+	}
+}
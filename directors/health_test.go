@@ -0,0 +1,60 @@
+package directors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var healthy int32 // accessed atomically
+	down := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" || atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer up.Close()
+
+	downTarget, _ := NewTarget(down.URL+"/api", 1)
+	upTarget, _ := NewTarget(up.URL, 1)
+	lb := NewLoadBalancer([]*Target{downTarget, upTarget}, RoundRobin())
+
+	lb.CheckHealth(HealthCheck{
+		Path:               "/health",
+		Interval:           10 * time.Millisecond,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	})
+	defer lb.Close()
+
+	waitFor := func(expected bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for downTarget.Healthy() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the target to be healthy:%v, got %+v", expected, downTarget.Health())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor(false)
+	if health := downTarget.Health(); health.LastError == "" {
+		t.Fatalf("Expected the error of the last check, got %+v", health)
+	}
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		lb.Direct(req)
+		if req.URL.Host != upTarget.URL.Host {
+			t.Fatalf("Expected only the healthy target, got %v", req.URL.Host)
+		}
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitFor(true)
+}
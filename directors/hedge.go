@@ -0,0 +1,124 @@
+package directors
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgePolicy configures hedged requests of a route. If the upstream
+// hasn't responded within the Percentile of the recent latencies of
+// the route, the request is sent to another target of the same
+// LoadBalancer as well, and the response which arrives first is used.
+// Only GET and HEAD requests without a body are hedged.
+type HedgePolicy struct {
+	// Percentile of the recent latencies used as the delay of the
+	// hedged request (default 95). No requests are hedged until
+	// MinSamples latencies are known (default 20).
+	Percentile float64
+	MinSamples int
+
+	// MinDelay and MaxDelay bound the delay, 0 means no bound.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// Budget caps the extra load, hedged requests are withdrawn from
+	// it like retries. nil means no limit.
+	Budget *RetryBudget
+
+	latencies *latencyWindow
+}
+
+// NewHedge returns a director which applies the hedge policy to the
+// request. It is meant to be used in the director chain of routes
+// with an upstream pool.
+func NewHedge(policy HedgePolicy) func(req *http.Request) {
+	if policy.Percentile <= 0 || policy.Percentile > 100 {
+		policy.Percentile = 95
+	}
+	if policy.MinSamples <= 0 {
+		policy.MinSamples = 20
+	}
+	policy.latencies = &latencyWindow{samples: make([]time.Duration, 0, 1000)}
+
+	return func(req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" || req.Header.Get("Upgrade") != "" {
+			return
+		}
+		*req = *req.WithContext(context.WithValue(req.Context(), "hedge.policy", &policy))
+	}
+}
+
+// GetHedgePolicy returns the HedgePolicy of the request, if any.
+func GetHedgePolicy(req *http.Request) (*HedgePolicy, bool) {
+	policy, ok := req.Context().Value("hedge.policy").(*HedgePolicy)
+	return policy, ok
+}
+
+// Observe records the latency of an upstream response of the route.
+func (p *HedgePolicy) Observe(latency time.Duration) {
+	p.latencies.add(latency)
+}
+
+// Delay returns the time to wait before sending a hedged
+// request. ok is false if not enough latencies are known.
+func (p *HedgePolicy) Delay() (delay time.Duration, ok bool) {
+	delay, ok = p.latencies.percentile(p.Percentile, p.MinSamples)
+	if !ok {
+		return 0, false
+	}
+
+	if p.MinDelay > 0 && delay < p.MinDelay {
+		delay = p.MinDelay
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay, true
+}
+
+// latencyWindow keeps the most recent latencies. Percentiles
+// are recomputed after every 50 new samples.
+type latencyWindow struct {
+	sync.Mutex
+	samples []time.Duration // ring buffer
+	next    int
+	fresh   int // samples since the last computation
+	cached  time.Duration
+	valid   bool
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, latency)
+	} else {
+		w.samples[w.next] = latency
+	}
+	w.next = (w.next + 1) % cap(w.samples)
+	w.fresh++
+}
+
+func (w *latencyWindow) percentile(p float64, minSamples int) (time.Duration, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.samples) < minSamples {
+		return 0, false
+	}
+	if w.valid && w.fresh < 50 {
+		return w.cached, true
+	}
+
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(p / 100 * float64(len(sorted)-1))
+	w.cached, w.valid, w.fresh = sorted[i], true, 0
+	return w.cached, true
+}
@@ -0,0 +1,44 @@
+package directors
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHedgeDelay(t *testing.T) {
+	director := NewHedge(HedgePolicy{Percentile: 90, MinSamples: 10, MaxDelay: 50 * time.Millisecond})
+
+	post := httptest.NewRequest("POST", "/", nil)
+	director(post)
+	if _, ok := GetHedgePolicy(post); ok {
+		t.Fatal("Expected POST requests not to be hedged")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	director(req)
+	policy, ok := GetHedgePolicy(req)
+	if !ok {
+		t.Fatal("Expected a hedge policy")
+	}
+
+	for i := 1; i < 10; i++ {
+		policy.Observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := policy.Delay(); ok {
+		t.Fatal("Expected no delay before MinSamples latencies")
+	}
+
+	policy.Observe(10 * time.Millisecond)
+	if delay, ok := policy.Delay(); !ok || delay != 9*time.Millisecond {
+		t.Fatalf("Expected 9ms delay, got %v", delay)
+	}
+
+	// recomputed after 50 new samples, bounded by MaxDelay
+	for i := 0; i < 50; i++ {
+		policy.Observe(time.Second)
+	}
+	if delay, _ := policy.Delay(); delay != 50*time.Millisecond {
+		t.Fatalf("Expected 50ms delay, got %v", delay)
+	}
+}
@@ -0,0 +1,143 @@
+package directors
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RequestInfo collects information about a proxied request while it is
+// processed by the directors, the transport and the response modifiers.
+// The ReverseProxy creates it for every incoming request, the same
+// RequestInfo is available from the request sent upstream.
+type RequestInfo struct {
+	Start         time.Time
+	Method        string
+	Host          string
+	Path          string
+	ClientIP      string
+	Route         string // the matched route definition
+	Upstream      string // the host the request is sent to
+	CorrelationID string
+	StatusCode    int
+	BytesWritten  int64
+	Duration      time.Duration
+	ErrorCode     string // the code of the ProxyError, if any
+	Rejected      bool   // the request was cancelled by a director
+	NoAccessLog   bool   // disabled by the matched route
+
+	RateLimited   bool          // the request passed a rate limiter
+	RateLimitWait time.Duration // time spent waiting in rate limiters
+
+	UpstreamStart    time.Time     // when the request was sent upstream
+	UpstreamDuration time.Duration // until the response headers were received
+	Retries          int           // requests resent by the transport
+	Hedged           bool          // a hedged request was sent
+	Coalesced        bool          // the response to an identical request was shared
+	CacheStatus      string        // e.g. "hit" or "miss" if the response cache is used
+	Trace            *TraceContext // set by the tracing director
+
+	// Config is left to the user of the ReverseProxy, e.g. for the
+	// configuration the request is directed with, so its observers
+	// and response modifiers can use the same one.
+	Config interface{}
+
+	// ResponseHeader is set on the response to the client,
+	// whether it comes from the upstream or it's an error.
+	ResponseHeader http.Header
+
+	done        []func()
+	headerFuncs []func(header http.Header)
+}
+
+// TraceContext identifies the spans of a proxied request
+// in a distributed trace (IDs are lowercase hex).
+type TraceContext struct {
+	TraceID        string
+	SpanID         string // the span of the proxied request
+	ParentSpanID   string // the span of the client, if any
+	UpstreamSpanID string // the span propagated to the upstream
+	Sampled        bool
+}
+
+// NewRequestInfo returns a RequestInfo for an incoming request.
+func NewRequestInfo(req *http.Request) *RequestInfo {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	return &RequestInfo{
+		Start:          time.Now(),
+		Method:         req.Method,
+		Host:           req.Host,
+		Path:           req.URL.Path,
+		ClientIP:       clientIP,
+		ResponseHeader: http.Header{},
+	}
+}
+
+// WithRequestInfo returns a copy of req with info stored in its context.
+func WithRequestInfo(req *http.Request, info *RequestInfo) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), "request.info", info))
+}
+
+// GetRequestInfo returns the RequestInfo of the request. It returns
+// a RequestInfo which is not shared with anything if the request
+// was not received by a ReverseProxy, so it's always safe to use.
+func GetRequestInfo(req *http.Request) *RequestInfo {
+	if info, ok := req.Context().Value("request.info").(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{ResponseHeader: http.Header{}}
+}
+
+// OnDone registers a function which is called when the response
+// is written to the client, e.g. to release resources acquired
+// by a director. Functions are called in reverse order.
+func (info *RequestInfo) OnDone(f func()) {
+	info.done = append(info.done, f)
+}
+
+// Done calls the functions registered with OnDone.
+// It's called by the ReverseProxy.
+func (info *RequestInfo) Done() {
+	for i := len(info.done) - 1; i >= 0; i-- {
+		info.done[i]()
+	}
+	info.done = nil
+}
+
+// OnResponseHeader registers a function which can change the header
+// of the response to the client before it's written, whether it comes
+// from the upstream or it's an error. Functions are called in order,
+// after ResponseHeader is applied.
+func (info *RequestInfo) OnResponseHeader(f func(header http.Header)) {
+	info.headerFuncs = append(info.headerFuncs, f)
+}
+
+// WriteResponseHeader applies ResponseHeader and the functions
+// registered with OnResponseHeader to the header of the response.
+// It's called by the ReverseProxy.
+func (info *RequestInfo) WriteResponseHeader(header http.Header) {
+	for key, values := range info.ResponseHeader {
+		if key == "Vary" {
+			// the response varies by both
+			header[key] = append(header[key], values...)
+			continue
+		}
+		header[key] = values
+	}
+
+	for _, f := range info.headerFuncs {
+		f(header)
+	}
+}
+
+// DisableAccessLog is a director which disables access
+// logging for the request. It is meant to be used in the
+// director chain of routes.
+func DisableAccessLog(req *http.Request) {
+	GetRequestInfo(req).NoAccessLog = true
+}
@@ -0,0 +1,328 @@
+package directors
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing policies.
+const (
+	PolicyRoundRobin         = "round_robin"
+	PolicyWeightedRoundRobin = "weighted_round_robin"
+	PolicyRandom             = "random"
+	PolicyLeastOutstanding   = "least_outstanding"
+	PolicyPowerOfTwoChoices  = "power_of_two_choices"
+)
+
+// Target is an upstream of a LoadBalancer. The URL is applied
+// to requests the same way as the target of NewSingleHost.
+type Target struct {
+	URL    *url.URL
+	Weight int // relative to the other targets, at least 1
+
+	outstanding int64 // requests in flight, accessed atomically
+	health      targetHealth
+	outlier     outlierState
+	pool        *LoadBalancer
+}
+
+// NewTarget returns a Target for the given URL. Weights
+// less than 1 are treated as 1.
+func NewTarget(rawURL string, weight int) (*Target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if weight < 1 {
+		weight = 1
+	}
+	return &Target{URL: u, Weight: weight}, nil
+}
+
+// Outstanding returns the number of requests in flight to the target.
+func (t *Target) Outstanding() int64 {
+	return atomic.LoadInt64(&t.outstanding)
+}
+
+// Policy selects the target of a request. It's
+// called with at least one target.
+type Policy interface {
+	Pick(targets []*Target, req *http.Request) *Target
+}
+
+// PolicyFunc is an adapter to use ordinary functions as Policies.
+type PolicyFunc func(targets []*Target, req *http.Request) *Target
+
+// Pick calls f(targets, req).
+func (f PolicyFunc) Pick(targets []*Target, req *http.Request) *Target {
+	return f(targets, req)
+}
+
+// NewPolicy returns the policy with the given name.
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case "", PolicyRoundRobin:
+		return RoundRobin(), nil
+	case PolicyWeightedRoundRobin:
+		return WeightedRoundRobin(), nil
+	case PolicyRandom:
+		return Random(), nil
+	case PolicyLeastOutstanding:
+		return LeastOutstanding(), nil
+	case PolicyPowerOfTwoChoices:
+		return PowerOfTwoChoices(), nil
+	case PolicyConsistentHash:
+		return nil, fmt.Errorf("%s requires a hash key, use ConsistentHash", name)
+	default:
+		return nil, fmt.Errorf("unknown load balancing policy %q", name)
+	}
+}
+
+// RoundRobin returns a Policy which picks the targets in turn.
+func RoundRobin() Policy {
+	var next uint64
+	return PolicyFunc(func(targets []*Target, req *http.Request) *Target {
+		n := atomic.AddUint64(&next, 1) - 1
+		return targets[n%uint64(len(targets))]
+	})
+}
+
+// WeightedRoundRobin returns a Policy which picks the targets in
+// proportion to their weights, interleaving them smoothly (e.g.
+// weights 2 and 1 result in A B A, not A A B).
+func WeightedRoundRobin() Policy {
+	var mu sync.Mutex
+	current := map[*Target]int{}
+
+	return PolicyFunc(func(targets []*Target, req *http.Request) *Target {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// forget targets which were removed
+		if len(current) > len(targets) {
+			pruned := map[*Target]int{}
+			for _, target := range targets {
+				pruned[target] = current[target]
+			}
+			current = pruned
+		}
+
+		var best *Target
+		total := 0
+		for _, target := range targets {
+			current[target] += target.Weight
+			total += target.Weight
+			if best == nil || current[target] > current[best] {
+				best = target
+			}
+		}
+		current[best] -= total
+		return best
+	})
+}
+
+// Random returns a Policy which picks a random target,
+// in proportion to their weights.
+func Random() Policy {
+	return PolicyFunc(func(targets []*Target, req *http.Request) *Target {
+		return randomTarget(targets)
+	})
+}
+
+// LeastOutstanding returns a Policy which picks the target with
+// the fewest requests in flight relative to its weight. Ties are
+// broken randomly.
+func LeastOutstanding() Policy {
+	return PolicyFunc(func(targets []*Target, req *http.Request) *Target {
+		var best []*Target
+		for _, target := range targets {
+			switch {
+			case len(best) == 0 || lessLoaded(target, best[0]):
+				best = append(best[:0], target)
+			case !lessLoaded(best[0], target):
+				best = append(best, target)
+			}
+		}
+		return best[rand.Intn(len(best))]
+	})
+}
+
+// PowerOfTwoChoices returns a Policy which picks two random
+// targets and selects the one with fewer requests in flight
+// relative to its weight.
+func PowerOfTwoChoices() Policy {
+	return PolicyFunc(func(targets []*Target, req *http.Request) *Target {
+		if len(targets) == 1 {
+			return targets[0]
+		}
+
+		i := rand.Intn(len(targets))
+		j := rand.Intn(len(targets) - 1)
+		if j >= i {
+			j++
+		}
+
+		if lessLoaded(targets[j], targets[i]) {
+			return targets[j]
+		}
+		return targets[i]
+	})
+}
+
+// lessLoaded reports whether a has fewer outstanding
+// requests per weight than b.
+func lessLoaded(a, b *Target) bool {
+	return a.Outstanding()*int64(b.Weight) < b.Outstanding()*int64(a.Weight)
+}
+
+func randomTarget(targets []*Target) *Target {
+	total := 0
+	for _, target := range targets {
+		total += target.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, target := range targets {
+		if n < target.Weight {
+			return target
+		}
+		n -= target.Weight
+	}
+	return targets[len(targets)-1]
+}
+
+// LoadBalancer is a director which distributes requests
+// across a pool of targets. Targets can be changed while
+// it's in use.
+type LoadBalancer struct {
+	sync.RWMutex
+	targets  []*Target
+	policy   Policy
+	stop     chan struct{} // stops the health checks
+	outliers *OutlierDetection
+}
+
+// NewLoadBalancer returns a LoadBalancer over the targets using
+// the given policy. Its Direct method can be used as the target
+// of a route, so one route can fan out across the pool.
+func NewLoadBalancer(targets []*Target, policy Policy) *LoadBalancer {
+	lb := &LoadBalancer{policy: policy}
+	lb.SetTargets(targets)
+	return lb
+}
+
+// Targets returns the targets of the LoadBalancer.
+func (lb *LoadBalancer) Targets() []*Target {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	targets := make([]*Target, len(lb.targets))
+	copy(targets, lb.targets)
+	return targets
+}
+
+// SetTargets replaces the targets of the LoadBalancer.
+func (lb *LoadBalancer) SetTargets(targets []*Target) {
+	lb.Lock()
+	defer lb.Unlock()
+
+	for _, target := range targets {
+		target.pool = lb
+	}
+	lb.targets = targets
+}
+
+// Available returns the targets which can receive requests,
+// i.e. they are healthy and not ejected as outliers.
+func (lb *LoadBalancer) Available() []*Target {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	targets := make([]*Target, 0, len(lb.targets))
+	for _, target := range lb.targets {
+		if target.Healthy() && !target.Ejected() {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Direct sends the request to the target selected by the policy
+// from the available targets. Requests are rejected with 503 if
+// there are none.
+//
+// The outstanding requests of the targets are tracked through
+// the RequestInfo, so the LoadBalancer must be used in the
+// director chain of a ReverseProxy.
+func (lb *LoadBalancer) Direct(req *http.Request) {
+	targets := lb.Available()
+	if len(targets) == 0 {
+		cancelRequestWithError(req, ErrServiceUnavailable("no upstream available"))
+		return
+	}
+
+	lb.direct(lb.policy.Pick(targets, req), req)
+}
+
+func (lb *LoadBalancer) direct(target *Target, req *http.Request) {
+	atomic.AddInt64(&target.outstanding, 1)
+	GetRequestInfo(req).OnDone(func() {
+		atomic.AddInt64(&target.outstanding, -1)
+	})
+
+	*req = *req.WithContext(context.WithValue(req.Context(), "upstream.target", target))
+	rewriteRequest(target.URL, req)
+}
+
+// UpstreamTarget returns the Target selected for
+// the request by a LoadBalancer.
+func UpstreamTarget(req *http.Request) (*Target, bool) {
+	target, ok := req.Context().Value("upstream.target").(*Target)
+	return target, ok
+}
+
+// Hedge returns a copy of the request directed to another available
+// target of the LoadBalancer which selected the target of req, so it
+// can be sent as a hedged request. ok is false if there's none.
+// The copy shares the body of req, so it must not have one.
+func Hedge(req *http.Request) (hedged *http.Request, ok bool) {
+	target, ok := UpstreamTarget(req)
+	if !ok || target.pool == nil {
+		return nil, false
+	}
+	lb := target.pool
+
+	available := lb.Available()
+	if len(available) == 0 {
+		return nil, false
+	}
+
+	var other *Target
+	if hashing, ok := lb.policy.(*consistentHash); ok {
+		// the next target of the key on the ring
+		other = hashing.pick(available, req, target)
+	} else {
+		others := []*Target{}
+		for _, t := range available {
+			if t != target {
+				others = append(others, t)
+			}
+		}
+		if len(others) > 0 {
+			other = lb.policy.Pick(others, req)
+		}
+	}
+	if other == nil {
+		return nil, false
+	}
+
+	hedged = req.Clone(req.Context())
+	lb.direct(other, hedged)
+	return hedged, true
+}
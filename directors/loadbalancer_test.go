@@ -0,0 +1,105 @@
+package directors
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testTargets(weights ...int) []*Target {
+	targets := []*Target{}
+	for i, weight := range weights {
+		target, _ := NewTarget(fmt.Sprintf("http://upstream%d:8080", i), weight)
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func pickHosts(policy Policy, targets []*Target, n int) map[string]int {
+	hosts := map[string]int{}
+	for i := 0; i < n; i++ {
+		hosts[policy.Pick(targets, nil).URL.Host]++
+	}
+	return hosts
+}
+
+func TestRoundRobin(t *testing.T) {
+	hosts := pickHosts(RoundRobin(), testTargets(1, 5, 1), 30)
+	for host, n := range hosts {
+		if n != 10 {
+			t.Fatalf("Expected even distribution, %v got %v", host, n)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	targets := testTargets(2, 1)
+	policy := WeightedRoundRobin()
+
+	sequence := ""
+	for i := 0; i < 6; i++ {
+		sequence += policy.Pick(targets, nil).URL.Host[8:9]
+	}
+	if sequence != "010010" {
+		t.Fatalf("Expected smooth weighted sequence 010010, got %v", sequence)
+	}
+
+	// removing a target doesn't break the rotation
+	if host := policy.Pick(targets[1:], nil).URL.Host; host != "upstream1:8080" {
+		t.Fatalf("Unexpected target %v", host)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	hosts := pickHosts(Random(), testTargets(1, 0, 3), 4000)
+	if hosts["upstream2:8080"] < 2*hosts["upstream0:8080"] {
+		t.Fatalf("Expected weighted distribution, got %v", hosts)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	targets := testTargets(1, 2, 1)
+	targets[0].outstanding = 2
+	targets[1].outstanding = 3 // 1.5 per weight
+	targets[2].outstanding = 1
+
+	for _, policy := range []Policy{LeastOutstanding(), PowerOfTwoChoices()} {
+		hosts := pickHosts(policy, targets, 100)
+		if hosts["upstream0:8080"] != 0 {
+			t.Fatalf("Expected the most loaded target to be avoided, got %v", hosts)
+		}
+	}
+
+	if hosts := pickHosts(LeastOutstanding(), targets, 10); hosts["upstream2:8080"] != 10 {
+		t.Fatalf("Expected the least loaded target, got %v", hosts)
+	}
+}
+
+func TestLoadBalancer(t *testing.T) {
+	lb := NewLoadBalancer(testTargets(1, 1), RoundRobin())
+
+	info := &RequestInfo{}
+	for _, expected := range []string{"upstream0:8080", "upstream1:8080", "upstream0:8080"} {
+		req := WithRequestInfo(httptest.NewRequest("GET", "http://localhost/", nil), info)
+		lb.Direct(req)
+		if req.URL.Host != expected || info.Upstream != expected {
+			t.Fatalf("Expected %v, got %v", expected, req.URL.Host)
+		}
+	}
+
+	if n := lb.Targets()[0].Outstanding(); n != 2 {
+		t.Fatalf("Expected 2 outstanding requests, got %v", n)
+	}
+	info.Done()
+	if n := lb.Targets()[0].Outstanding(); n != 0 {
+		t.Fatalf("Expected no outstanding requests, got %v", n)
+	}
+
+	lb.SetTargets(nil)
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	lb.Direct(req)
+	if err, ok := req.Context().Value("error").(*ProxyError); !ok || err.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 without targets, got %v", req.Context().Value("error"))
+	}
+}
@@ -0,0 +1,223 @@
+package directors
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Reasons of ejecting a target.
+const (
+	EjectConsecutive5xx    = "consecutive_5xx"
+	EjectConsecutiveErrors = "consecutive_errors"
+	EjectLatency           = "latency"
+)
+
+// OutlierDetection configures passive outlier detection of the
+// targets of a LoadBalancer. The responses of the targets are
+// reported by the transport (see Target.Observe), targets which
+// fail or are too slow are ejected from load balancing for a
+// while.
+type OutlierDetection struct {
+	// A target is ejected after Consecutive5xx responses with
+	// 5xx status (default 5) or ConsecutiveErrors connection
+	// errors (default 5) in a row.
+	Consecutive5xx    int
+	ConsecutiveErrors int
+
+	// LatencyFactor ejects targets whose average latency is more
+	// than LatencyFactor times the average of the other targets.
+	// It's disabled if 0. The average is taken after LatencySamples
+	// responses (default 20).
+	LatencyFactor  float64
+	LatencySamples int
+
+	// A target is ejected for BaseEjectionTime (default 30s), which
+	// is doubled for every ejection in a row up to MaxEjectionTime
+	// (default 5m). Targets which were not ejected for MaxEjectionTime
+	// start with BaseEjectionTime again.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+
+	// MaxEjectionPercent is the percentage of targets which can be
+	// ejected at the same time (default 50), rounded down. Targets of
+	// pools too small for the percentage are never ejected.
+	MaxEjectionPercent int
+
+	// OnEject is called when a target is ejected.
+	OnEject func(target *Target, reason string)
+}
+
+// outlierState is the outlier detection state kept by a Target.
+type outlierState struct {
+	sync.Mutex
+	consecutive5xx    int
+	consecutiveErrors int
+	latency           float64 // moving average in seconds
+	samples           int
+	ejections         int // in a row
+	ejectedUntil      time.Time
+}
+
+// DetectOutliers enables passive outlier detection on the targets.
+func (lb *LoadBalancer) DetectOutliers(od OutlierDetection) {
+	if od.Consecutive5xx <= 0 {
+		od.Consecutive5xx = 5
+	}
+	if od.ConsecutiveErrors <= 0 {
+		od.ConsecutiveErrors = 5
+	}
+	if od.LatencySamples <= 0 {
+		od.LatencySamples = 20
+	}
+	if od.BaseEjectionTime <= 0 {
+		od.BaseEjectionTime = 30 * time.Second
+	}
+	if od.MaxEjectionTime <= 0 {
+		od.MaxEjectionTime = 5 * time.Minute
+	}
+	if od.MaxEjectionPercent <= 0 {
+		od.MaxEjectionPercent = 50
+	}
+
+	lb.Lock()
+	defer lb.Unlock()
+
+	lb.outliers = &od
+}
+
+// Ejected reports whether the target is ejected as an outlier.
+func (t *Target) Ejected() bool {
+	t.outlier.Lock()
+	defer t.outlier.Unlock()
+
+	return time.Now().Before(t.outlier.ejectedUntil)
+}
+
+// Observe records a response of the target (resp is nil if the
+// round trip failed with err) for outlier detection. It's called
+// by the transport of the ReverseProxy.
+func (t *Target) Observe(resp *http.Response, err error, latency time.Duration) {
+	lb := t.pool
+	if lb == nil {
+		return
+	}
+
+	lb.RLock()
+	od := lb.outliers
+	lb.RUnlock()
+	if od == nil {
+		return
+	}
+
+	reason := ""
+	s := &t.outlier
+
+	s.Lock()
+	switch {
+	case err != nil:
+		s.consecutiveErrors++
+		if s.consecutiveErrors >= od.ConsecutiveErrors {
+			reason = EjectConsecutiveErrors
+		}
+
+	case resp.StatusCode >= 500:
+		s.consecutiveErrors = 0
+		s.consecutive5xx++
+		if s.consecutive5xx >= od.Consecutive5xx {
+			reason = EjectConsecutive5xx
+		}
+
+	default:
+		s.consecutiveErrors = 0
+		s.consecutive5xx = 0
+	}
+
+	if err == nil {
+		if s.samples == 0 {
+			s.latency = latency.Seconds()
+		} else {
+			s.latency = 0.9*s.latency + 0.1*latency.Seconds()
+		}
+		s.samples++
+	}
+	averageLatency, samples := s.latency, s.samples
+	s.Unlock()
+
+	if reason == "" && od.LatencyFactor > 0 && samples >= od.LatencySamples {
+		if others := lb.averageLatency(t, od.LatencySamples); others > 0 && averageLatency > od.LatencyFactor*others {
+			reason = EjectLatency
+		}
+	}
+
+	if reason != "" && lb.eject(t, od, reason) && od.OnEject != nil {
+		od.OnEject(t, reason)
+	}
+}
+
+// averageLatency returns the average latency of the available
+// targets other than t, 0 if it's not known.
+func (lb *LoadBalancer) averageLatency(t *Target, minSamples int) float64 {
+	var sum float64
+	var n int
+	for _, target := range lb.Available() {
+		if target == t {
+			continue
+		}
+
+		target.outlier.Lock()
+		if target.outlier.samples >= minSamples {
+			sum += target.outlier.latency
+			n++
+		}
+		target.outlier.Unlock()
+	}
+
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// eject removes the target from load balancing unless too many
+// targets are ejected already. It reports whether it was ejected.
+func (lb *LoadBalancer) eject(t *Target, od *OutlierDetection, reason string) bool {
+	lb.Lock()
+	defer lb.Unlock()
+
+	ejected := 0
+	for _, target := range lb.targets {
+		if target.Ejected() {
+			ejected++
+		}
+	}
+
+	maxEjected := len(lb.targets) * od.MaxEjectionPercent / 100
+	if ejected >= maxEjected || t.Ejected() {
+		return false
+	}
+
+	s := &t.outlier
+	s.Lock()
+	now := time.Now()
+	if now.Sub(s.ejectedUntil) > od.MaxEjectionTime {
+		s.ejections = 0
+	}
+
+	duration := od.BaseEjectionTime
+	for i := 0; i < s.ejections && duration < od.MaxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > od.MaxEjectionTime {
+		duration = od.MaxEjectionTime
+	}
+
+	s.ejections++
+	s.ejectedUntil = now.Add(duration)
+	s.consecutive5xx, s.consecutiveErrors, s.samples = 0, 0, 0
+	s.Unlock()
+
+	log.Printf("upstream target %s ejected for %v: %s", t.URL, duration, reason)
+	return true
+}
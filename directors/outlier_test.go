@@ -0,0 +1,102 @@
+package directors
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjection(t *testing.T) {
+	targets := testTargets(1, 1, 1)
+	lb := NewLoadBalancer(targets, RoundRobin())
+
+	ejections := map[string]string{}
+	lb.DetectOutliers(OutlierDetection{
+		Consecutive5xx:    2,
+		ConsecutiveErrors: 2,
+		BaseEjectionTime:  50 * time.Millisecond,
+		MaxEjectionTime:   time.Second,
+		OnEject: func(target *Target, reason string) {
+			ejections[target.URL.Host] = reason
+		},
+	})
+
+	failed := &http.Response{StatusCode: http.StatusBadGateway}
+	ok := &http.Response{StatusCode: http.StatusOK}
+
+	// 5xx responses must be consecutive
+	targets[0].Observe(failed, nil, time.Millisecond)
+	targets[0].Observe(ok, nil, time.Millisecond)
+	targets[0].Observe(failed, nil, time.Millisecond)
+	if targets[0].Ejected() {
+		t.Fatal("Unexpected ejection")
+	}
+
+	targets[0].Observe(failed, nil, time.Millisecond)
+	if !targets[0].Ejected() || ejections["upstream0:8080"] != EjectConsecutive5xx {
+		t.Fatalf("Expected ejection after consecutive 5xx, got %v", ejections)
+	}
+
+	if available := lb.Available(); len(available) != 2 {
+		t.Fatalf("Expected 2 available targets, got %v", len(available))
+	}
+
+	// at most 50% of the targets are ejected
+	for i := 0; i < 2; i++ {
+		targets[1].Observe(nil, errors.New("connection refused"), time.Millisecond)
+		targets[2].Observe(nil, errors.New("connection refused"), time.Millisecond)
+	}
+	if targets[1].Ejected() || targets[2].Ejected() {
+		t.Fatalf("Expected max ejection percent to be respected, got %v", ejections)
+	}
+
+	// the target returns after the ejection time,
+	// ejecting it again doubles the ejection time
+	time.Sleep(60 * time.Millisecond)
+	if targets[0].Ejected() {
+		t.Fatal("Expected the target to return")
+	}
+
+	targets[0].Observe(failed, nil, time.Millisecond)
+	targets[0].Observe(failed, nil, time.Millisecond)
+	health := targets[0].Health()
+	if !health.Ejected || health.Ejections != 2 || time.Until(health.EjectedUntil) < 60*time.Millisecond {
+		t.Fatalf("Expected longer second ejection, got %+v", health)
+	}
+}
+
+func TestOutlierSinglePool(t *testing.T) {
+	targets := testTargets(1)
+	lb := NewLoadBalancer(targets, RoundRobin())
+	lb.DetectOutliers(OutlierDetection{Consecutive5xx: 1})
+
+	// 50% of one target is none
+	targets[0].Observe(&http.Response{StatusCode: http.StatusBadGateway}, nil, time.Millisecond)
+	if targets[0].Ejected() {
+		t.Fatal("Expected the only target not to be ejected")
+	}
+}
+
+func TestOutlierLatency(t *testing.T) {
+	targets := testTargets(1, 1, 1)
+	lb := NewLoadBalancer(targets, RoundRobin())
+	lb.DetectOutliers(OutlierDetection{
+		LatencyFactor:  3,
+		LatencySamples: 5,
+	})
+
+	for i := 0; i < 5; i++ {
+		for j, target := range targets {
+			latency := 10 * time.Millisecond
+			if j == 2 {
+				latency = 100 * time.Millisecond
+			}
+			target.Observe(&http.Response{StatusCode: http.StatusOK}, nil, latency)
+		}
+	}
+
+	if targets[0].Ejected() || targets[1].Ejected() || !targets[2].Ejected() {
+		t.Fatalf("Expected the slow target to be ejected")
+	}
+}
@@ -11,6 +11,13 @@ func NewRateLimiter(delay, timeout time.Duration, burst int) func(*http.Request)
 	limiter := ratelimit.NewClientLimiter(delay, timeout, burst)
 
 	return func(req *http.Request) {
+		start := time.Now()
+		defer func() {
+			info := GetRequestInfo(req)
+			info.RateLimited = true
+			info.RateLimitWait += time.Since(start)
+		}()
+
 		limiter.Wait(req.RemoteAddr) // TODO: RemoteAddr won't work properly, it's here just for illustration. A truly unique ID is required.
 	}
 }
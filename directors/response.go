@@ -0,0 +1,64 @@
+package directors
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ChainResponse takes a number of response modifiers and chains them,
+// returning a single modifier. Modifiers are called in order, the first
+// error stops the chain and is handled by the proxy's ErrorHandler.
+func ChainResponse(modifiers ...func(*http.Response) error) func(*http.Response) error {
+	for _, modifier := range modifiers {
+		if modifier == nil {
+			log.Fatal("response modifier can not be nil")
+		}
+	}
+
+	return func(resp *http.Response) error {
+		for _, modifier := range modifiers {
+			if err := modifier(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Respond answers the request at the proxy with the status code and
+// header, without a body. The chained directors stop processing the
+// request and the RoundTripper returns the response instead of calling
+// the upstream, e.g. for CORS preflight requests.
+func Respond(req *http.Request, statusCode int, header http.Header) {
+	resp := &http.Response{
+		Status:     strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+	}
+
+	ctx := context.WithValue(req.Context(), "response", resp)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	*req = *req.WithContext(ctx)
+}
+
+// MatchedRoute returns the route definition (e.g. "/api/:user_id/*")
+// the router matched for the request. Response modifiers can use it
+// with resp.Request.
+func MatchedRoute(req *http.Request) string {
+	route, _ := req.Context().Value("request.route").(string)
+	return route
+}
+
+// PathVariable returns the value of a path variable defined in the
+// matched route by ":key" syntax.
+func PathVariable(req *http.Request, key string) string {
+	value, _ := req.Context().Value(key).(string)
+	return value
+}
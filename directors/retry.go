@@ -0,0 +1,160 @@
+package directors
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures retries of the requests of a route. Requests
+// are retried on connection errors and on the configured status codes
+// if they are safe to resend: their method is idempotent or they carry
+// an Idempotency-Key header. Retries are sent by the transport of the
+// ReverseProxy to the same target.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first
+	// attempt (default 2).
+	MaxRetries int
+
+	// StatusCodes are the response statuses which are retried.
+	StatusCodes []int
+
+	// The back-off before the nth retry is a random duration up to
+	// BaseBackoff*2^(n-1) (default 25ms), capped at MaxBackoff
+	// (default 250ms).
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// MaxBodyBytes is the size of request bodies which are buffered
+	// to be resent (default 64KiB). Requests with larger bodies are
+	// not retried.
+	MaxBodyBytes int64
+
+	// Budget limits the retries of the route, nil means no limit.
+	Budget *RetryBudget
+}
+
+// NewRetry returns a director which applies the retry policy to
+// the request. It is meant to be used in the director chain of routes.
+func NewRetry(policy RetryPolicy) func(req *http.Request) {
+	if policy.MaxRetries <= 0 {
+		policy.MaxRetries = 2
+	}
+	if policy.BaseBackoff <= 0 {
+		policy.BaseBackoff = 25 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 250 * time.Millisecond
+	}
+	if policy.MaxBodyBytes <= 0 {
+		policy.MaxBodyBytes = 64 << 10
+	}
+
+	return func(req *http.Request) {
+		*req = *req.WithContext(context.WithValue(req.Context(), "retry.policy", &policy))
+	}
+}
+
+// GetRetryPolicy returns the RetryPolicy of the request, if any.
+func GetRetryPolicy(req *http.Request) (*RetryPolicy, bool) {
+	policy, ok := req.Context().Value("retry.policy").(*RetryPolicy)
+	return policy, ok
+}
+
+// Retryable reports whether the request can be resent.
+func (p *RetryPolicy) Retryable(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// RetryStatus reports whether responses with the status are retried.
+func (p *RetryPolicy) RetryStatus(statusCode int) bool {
+	for _, code := range p.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the time to wait before the nth retry
+// (starting from 1), with full jitter.
+func (p *RetryPolicy) Backoff(n int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < n && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// RetryBudget limits retries to a percentage of the requests in
+// the last 10 seconds, so retries can't multiply the load of an
+// upstream which is failing anyway. A few retries per second are
+// always allowed, so routes with little traffic can retry too.
+type RetryBudget struct {
+	sync.Mutex
+	percent      int
+	minPerSecond int
+	buckets      [10]budgetBucket // by second
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewRetryBudget returns a RetryBudget which allows retries up to
+// percent of the requests, plus minPerSecond retries per second.
+func NewRetryBudget(percent, minPerSecond int) *RetryBudget {
+	return &RetryBudget{percent: percent, minPerSecond: minPerSecond}
+}
+
+// Request records a request.
+func (b *RetryBudget) Request() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.bucket(time.Now()).requests++
+}
+
+// Withdraw reports whether a retry is allowed, and records it if it is.
+func (b *RetryBudget) Withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if now.Unix()-bucket.second < int64(len(b.buckets)) {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	allowed := requests*b.percent/100 + b.minPerSecond*len(b.buckets)
+	if retries >= allowed {
+		return false
+	}
+
+	b.bucket(now).retries++
+	return true
+}
+
+// bucket returns the bucket of the current second.
+func (b *RetryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
@@ -0,0 +1,52 @@
+package directors
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	policy := RetryPolicy{}
+
+	for method, retryable := range map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false} {
+		if policy.Retryable(httptest.NewRequest(method, "/", nil)) != retryable {
+			t.Fatalf("Expected %s retryable to be %v", method, retryable)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Idempotency-Key", "8e03978e")
+	if !policy.Retryable(req) {
+		t.Fatal("Expected requests with Idempotency-Key to be retryable")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		if backoff := policy.Backoff(1); backoff > 10*time.Millisecond {
+			t.Fatalf("Expected at most 10ms before the first retry, got %v", backoff)
+		}
+		if backoff := policy.Backoff(5); backoff > 30*time.Millisecond {
+			t.Fatalf("Expected at most 30ms, got %v", backoff)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(10, 0)
+
+	for i := 0; i < 50; i++ {
+		budget.Request()
+	}
+
+	retries := 0
+	for budget.Withdraw() {
+		retries++
+	}
+	if retries != 5 {
+		t.Fatalf("Expected 5 retries for 50 requests, got %v", retries)
+	}
+}
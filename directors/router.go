@@ -2,37 +2,122 @@ package directors
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"sort"
 	"strings"
 
 	"sync"
 )
 
-type errNotFound error
-
 type routeTree struct {
 	sync.RWMutex
 	route    string
+	pattern  string
 	director func(*http.Request)
 	children map[string]*routeTree
 }
 
+// NewRouter returns a director which routes requests to the
+// directors of the matching route definitions in targets.
 func NewRouter(targets map[string]func(*http.Request)) func(req *http.Request) {
-	rt := buildRouteTree(targets)
+	return NewDynamicRouter(targets).Direct
+}
 
-	return func(req *http.Request) {
-		if d, match := rt.matchRoute(req.URL.Path); match {
-			d(req)
-		} else {
-			cancelRequestWithError(req, errors.New("invalid target"))
+// Router routes requests to the directors registered for route
+// definitions. Unlike the director returned by NewRouter it allows
+// routes to be added, replaced and removed while it is in use.
+type Router struct {
+	sync.Mutex // serializes writers
+	root       *routeTree
+	targets    map[string]func(*http.Request)
+}
+
+// NewDynamicRouter returns a Router with the given initial targets.
+// Invalid route definitions are skipped.
+func NewDynamicRouter(targets map[string]func(*http.Request)) *Router {
+	router := &Router{
+		root: &routeTree{
+			children: map[string]*routeTree{},
+		},
+		targets: map[string]func(*http.Request){},
+	}
+
+	for routeDefinition, target := range targets {
+		if _, err := router.Set(routeDefinition, target); err != nil {
+			log.Println(err)
 		}
 	}
+
+	return router
+}
+
+// Direct is the director of the router.
+func (r *Router) Direct(req *http.Request) {
+	if d, match := r.root.matchRoute(req.URL.Path); match {
+		d(req)
+	} else {
+		cancelRequestWithError(req, NewProxyError(http.StatusNotFound, CodeInvalidTarget, "invalid target"))
+	}
+}
+
+// Set adds a route or replaces the director of an existing route.
+// It returns true if the route already existed.
+func (r *Router) Set(routeDefinition string, target func(*http.Request)) (bool, error) {
+	if target == nil {
+		return false, fmt.Errorf("invalid route %q: director can not be nil", routeDefinition)
+	}
+
+	if err := ValidateRoute(routeDefinition); err != nil {
+		return false, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.root.addRoute(routeDefinition, target); err != nil {
+		return false, err
+	}
+
+	_, exists := r.targets[routeDefinition]
+	r.targets[routeDefinition] = target
+	return exists, nil
+}
+
+// Delete removes a route. It returns false if there was no such route.
+func (r *Router) Delete(routeDefinition string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.targets[routeDefinition]; !ok {
+		return false
+	}
+
+	r.root.removeRoute(routeDefinition)
+	delete(r.targets, routeDefinition)
+	return true
+}
+
+// Routes returns the route definitions of the router.
+func (r *Router) Routes() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	routes := make([]string, 0, len(r.targets))
+	for routeDefinition := range r.targets {
+		routes = append(routes, routeDefinition)
+	}
+	sort.Strings(routes)
+	return routes
 }
 
 // matchRoute finds the route for a given path
 // variable values defined in the route by ":key" syntax
 // are applied to the request context by wrapping the director.
+// A static segment takes precedence over a variable at the same
+// position, a variable matches the last segment of the path as
+// well, and the deepest "*" is used when nothing else matches.
 func (rt *routeTree) matchRoute(path string) (func(*http.Request), bool) {
 	// TODO: sanitize incoming paths for pattern matching
 
@@ -45,39 +130,47 @@ func (rt *routeTree) matchRoute(path string) (func(*http.Request), bool) {
 	for _, pathSegment := range pathSegments {
 
 		currentNode.RLock()
-		wildcardNode, ok := currentNode.children["*"]
+		wildcardNode, hasWildcard := currentNode.children["*"]
+		nextNode, hasNext := currentNode.children[pathSegment]
+		variableNode, hasVariable := currentNode.children[":"]
 		currentNode.RUnlock()
 
-		if ok {
+		if hasWildcard {
 			wildcardmatch = true
-			director = directorWithVariables(wildcardNode.director, pathVariables)
+			director = wildcardNode.directorWithVariables(pathVariables)
 		}
 
-		currentNode.RLock()
-		variableNode, ok := currentNode.children[":"]
-		currentNode.RUnlock()
+		// static segments take precedence over variables
+		switch {
+		case hasNext:
+			currentNode = nextNode
+			match = true
 
-		if ok {
+		case hasVariable:
 			variable := strings.TrimPrefix(variableNode.route, ":")
 			pathVariables[variable] = pathSegment
 			currentNode = variableNode
 			match = true
-		}
-
-		currentNode.RLock()
-		nextNode, ok := currentNode.children[pathSegment]
-		currentNode.RUnlock()
 
-		if ok {
-			currentNode = nextNode
-			match = true
-		} else {
+		default:
 			match = false
 		}
+
+		if !match {
+			break
+		}
 	}
 
 	if match {
-		director = directorWithVariables(currentNode.director, pathVariables)
+		currentNode.RLock()
+		registered := currentNode.pattern != ""
+		currentNode.RUnlock()
+
+		// the path ends on a node between the segments of other
+		// routes, the wildcard seen on the way still applies
+		if registered || !wildcardmatch {
+			director = currentNode.directorWithVariables(pathVariables)
+		}
 	}
 
 	return director, match || wildcardmatch
@@ -88,68 +181,127 @@ func newRouteTree(route string) *routeTree {
 		route: route,
 		director: func(req *http.Request) {
 			// handler on incomplete routes doesn't match by default
-			cancelRequestWithError(req, errNotFound(errors.New("not found")))
-			// TODO: check error handling.. 404?
+			cancelRequestWithError(req, ErrNotFound("not found"))
 		},
 		children: map[string]*routeTree{},
 	}
 }
 
-func buildRouteTree(targets map[string]func(*http.Request)) *routeTree {
-	// TODO: sanitize route definitions
-	root := &routeTree{
-		children: map[string]*routeTree{},
+// addRoute sets the director for the route definition, creating the
+// missing nodes of the tree. Each node is locked while it's modified
+// so the tree can be used for matching routes in the meantime.
+func (rt *routeTree) addRoute(routeDefinition string, target func(*http.Request)) error {
+	path := strings.Split(strings.Trim(routeDefinition, "/"), "/")
+
+	// check for conflicting variable names before modifying the tree
+	currentNode := rt
+	for _, pathSegment := range path {
+		key := pathSegment
+		if strings.HasPrefix(pathSegment, ":") {
+			key = ":"
+		}
+
+		currentNode.RLock()
+		child, ok := currentNode.children[key]
+		currentNode.RUnlock()
+		if !ok {
+			break
+		}
+
+		if key == ":" && child.route != pathSegment {
+			return fmt.Errorf("invalid route %q: variable %s conflicts with %s", routeDefinition, pathSegment, child.route)
+		}
+		currentNode = child
 	}
 
-	root.Lock()
-	defer root.Unlock()
+	currentNode = rt
+	for _, pathSegment := range path {
+		key := pathSegment
+		if strings.HasPrefix(pathSegment, ":") {
+			key = ":"
+		}
 
-	for routeDefinition, target := range targets {
-		if !routePathIsValid(routeDefinition) {
-			continue
+		currentNode.Lock()
+		child, ok := currentNode.children[key]
+		if !ok {
+			child = newRouteTree(pathSegment)
+			currentNode.children[key] = child
 		}
+		currentNode.Unlock()
+
+		currentNode = child
+	}
+
+	// set director on the final pathSegment (full match)
+	currentNode.Lock()
+	currentNode.director = target
+	currentNode.pattern = routeDefinition
+	currentNode.Unlock()
+
+	return nil
+}
 
-		path := strings.Split(strings.Trim(routeDefinition, "/"), "/")
-		currentNode := root
+// removeRoute removes the director of the route definition and
+// prunes the nodes which are no longer part of any route.
+func (rt *routeTree) removeRoute(routeDefinition string) {
+	path := strings.Split(strings.Trim(routeDefinition, "/"), "/")
 
-		var child *routeTree
-		var ok bool
+	nodes := []*routeTree{rt}
+	keys := []string{}
+	currentNode := rt
+	for _, pathSegment := range path {
+		key := pathSegment
+		if strings.HasPrefix(pathSegment, ":") {
+			key = ":"
+		}
 
-		for _, pathSegment := range path {
+		currentNode.RLock()
+		child, ok := currentNode.children[key]
+		currentNode.RUnlock()
+		if !ok {
+			return
+		}
 
-			if strings.HasPrefix(pathSegment, ":") {
-				child, ok = currentNode.children[":"]
-			} else {
-				child, ok = currentNode.children[pathSegment]
-			}
-			if !ok {
-				child = newRouteTree(pathSegment)
-			}
+		nodes = append(nodes, child)
+		keys = append(keys, key)
+		currentNode = child
+	}
 
-			switch {
-			case pathSegment == "*":
-				currentNode.children["*"] = child
-				child.director = target
+	currentNode.Lock()
+	currentNode.director = newRouteTree("").director
+	currentNode.pattern = ""
+	currentNode.Unlock()
 
-			case strings.HasPrefix(pathSegment, ":"):
-				currentNode.children[":"] = child
-				currentNode = child
+	for i := len(nodes) - 1; i > 0; i-- {
+		node, parent := nodes[i], nodes[i-1]
 
-			default:
-				currentNode.children[pathSegment] = child
-				currentNode = child
-			}
+		node.RLock()
+		unused := node.pattern == "" && len(node.children) == 0
+		node.RUnlock()
+		if !unused {
+			return
 		}
 
-		// set director on the final pathSegment (full match)
-		child.director = target
+		parent.Lock()
+		delete(parent.children, keys[i-1])
+		parent.Unlock()
 	}
+}
+
+func (rt *routeTree) directorWithVariables(variables map[string]string) func(*http.Request) {
+	rt.RLock()
+	pattern, director := rt.pattern, rt.director
+	rt.RUnlock()
 
-	return root
+	return directorWithVariables(pattern, director, variables)
 }
 
-func directorWithVariables(director func(*http.Request), variables map[string]string) func(*http.Request) {
+func directorWithVariables(pattern string, director func(*http.Request), variables map[string]string) func(*http.Request) {
 	return func(req *http.Request) {
+		if pattern != "" {
+			setRequestVariable(req, "request.route", pattern)
+			GetRequestInfo(req).Route = pattern
+		}
 		for key, value := range variables {
 			setRequestVariable(req, key, value)
 		}
@@ -161,16 +313,32 @@ func setRequestVariable(req *http.Request, key, value string) {
 	*req = *req.WithContext(context.WithValue(req.Context(), key, value))
 }
 
-func routePathIsValid(path string) bool {
-	// validate path here
-	// If it contains * it must be the last character
+// ValidateRoute checks a route definition for the router.
+// Routes must start with '/', variables must be named (":key")
+// and the '*' wildcard is only allowed as the last segment.
+func ValidateRoute(path string) error {
 	// TODO: better use of wildcards (allow surrounded wildcard etc.)
-	return true
-}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid route %q: must start with '/'", path)
+	}
+
+	if path == "/" {
+		return nil
+	}
+
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, pathSegment := range pathSegments {
+		switch {
+		case pathSegment == "":
+			return fmt.Errorf("invalid route %q: empty path segment", path)
+
+		case pathSegment == ":":
+			return fmt.Errorf("invalid route %q: unnamed variable", path)
+
+		case strings.Contains(pathSegment, "*") && (pathSegment != "*" || i != len(pathSegments)-1):
+			return fmt.Errorf("invalid route %q: '*' must be the last segment", path)
+		}
+	}
 
-func cancelRequestWithError(req *http.Request, err error) {
-	ctx := context.WithValue(req.Context(), "error", err)
-	ctx, cancel := context.WithCancel(ctx)
-	cancel()
-	*req = *req.WithContext(ctx)
+	return nil
 }
@@ -48,7 +48,7 @@ func TestMatchRoutes(t *testing.T) {
 		"/": appendReqestPath,
 	}
 
-	rt := buildRouteTree(targets)
+	rt := NewDynamicRouter(targets).root
 	urlStr := "http://localhost"
 
 	for _, path := range incomingPaths {
@@ -70,3 +70,41 @@ func TestMatchRoutes(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchRoutePrecedence(t *testing.T) {
+	var matched string
+	target := func(route string) func(*http.Request) {
+		return func(req *http.Request) { matched = route }
+	}
+
+	rt := NewDynamicRouter(map[string]func(*http.Request){
+		"/users/:user_id":         target("/users/:user_id"),
+		"/users/me":               target("/users/me"),
+		"/users/:user_id/friends": target("/users/:user_id/friends"),
+		"/users/*":                target("/users/*"),
+		"/a/*":                    target("/a/*"),
+		"/a/b/c":                  target("/a/b/c"),
+	}).root
+
+	tests := map[string]string{
+		"/users/me":              "/users/me",
+		"/users/user123":         "/users/:user_id",
+		"/users/user123/friends": "/users/:user_id/friends",
+		"/users/user123/posts":   "/users/*",
+		"/a/b":                   "/a/*",
+		"/a/x":                   "/a/*",
+		"/a/b/c":                 "/a/b/c",
+		"/a/b/c/d":               "/a/*",
+	}
+
+	for path, expected := range tests {
+		matched = ""
+		req, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		if d, match := rt.matchRoute(path); match {
+			d(req)
+		}
+		if matched != expected {
+			t.Fatalf("[%v] Invalid route. Expected:%v Got:%v", path, expected, matched)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package directors
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeouts of the requests of a route. Zero values mean no timeout.
+type Timeouts struct {
+	// Connect limits establishing a new connection to the upstream.
+	Connect time.Duration
+
+	// ResponseHeader limits waiting for the response headers after
+	// the request is sent, for every attempt (see RetryPolicy).
+	ResponseHeader time.Duration
+
+	// Total limits the whole request, including retries and
+	// copying the response body to the client.
+	Total time.Duration
+
+	// DeadlineHeader is the request header the remaining time is
+	// sent to the upstream in, e.g. "X-Request-Deadline" (in
+	// milliseconds) or "grpc-timeout" (in the gRPC format).
+	DeadlineHeader string
+}
+
+// NewTimeouts returns a director which applies the timeouts to the
+// request. Requests which time out are answered with 504 by the
+// ReverseProxy. It is meant to be used in the director chain of routes.
+func NewTimeouts(timeouts Timeouts) func(req *http.Request) {
+	return func(req *http.Request) {
+		ctx := context.WithValue(req.Context(), "timeouts", &timeouts)
+		if timeouts.Total > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeouts.Total)
+			GetRequestInfo(req).OnDone(cancel)
+		}
+		*req = *req.WithContext(ctx)
+	}
+}
+
+// GetTimeouts returns the Timeouts of the request, if any.
+func GetTimeouts(req *http.Request) (*Timeouts, bool) {
+	return TimeoutsFromContext(req.Context())
+}
+
+// TimeoutsFromContext returns the Timeouts stored in the context of
+// a request, e.g. in the context of a dial.
+func TimeoutsFromContext(ctx context.Context) (*Timeouts, bool) {
+	timeouts, ok := ctx.Value("timeouts").(*Timeouts)
+	return timeouts, ok
+}
+
+// SetDeadlineHeader sets the DeadlineHeader of the request to the
+// time remaining until the deadline of its context, if it has one.
+// It's called by the transport before every attempt.
+func (t *Timeouts) SetDeadlineHeader(req *http.Request) {
+	deadline, ok := req.Context().Deadline()
+	if t.DeadlineHeader == "" || !ok {
+		return
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < time.Millisecond {
+		remaining = time.Millisecond
+	}
+	ms := int64(remaining / time.Millisecond)
+
+	if strings.EqualFold(t.DeadlineHeader, "grpc-timeout") {
+		// at most 8 digits are allowed
+		if ms < 1e8 {
+			req.Header.Set(t.DeadlineHeader, strconv.FormatInt(ms, 10)+"m")
+		} else {
+			req.Header.Set(t.DeadlineHeader, strconv.FormatInt(ms/1000, 10)+"S")
+		}
+		return
+	}
+	req.Header.Set(t.DeadlineHeader, strconv.FormatInt(ms, 10))
+}
@@ -0,0 +1,26 @@
+package directors
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadlineHeader(t *testing.T) {
+	for header, expected := range map[string]string{
+		"X-Request-Deadline": "1499",
+		"grpc-timeout":       "1499m",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(1500*time.Millisecond))
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		timeouts := &Timeouts{DeadlineHeader: header}
+		timeouts.SetDeadlineHeader(req)
+		if value := req.Header.Get(header); value != expected {
+			t.Fatalf("Expected %s: %s, got %q", header, expected, value)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// problem is the application/problem+json (RFC 7807) representation
+// of a ProxyError.
+type problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail,omitempty"`
+	Code          string `json:"code,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// StatusClientClosedRequest is the status of requests cancelled by
+// the client before the response was written (as used by nginx).
+const StatusClientClosedRequest = 499
+
+// WriteError is the ErrorHandler of the ReverseProxy. Errors attached
+// by directors are rendered with their own status code, timeouts are
+// reported as 504, requests cancelled by the client as 499 without a
+// body and everything else (e.g. unreachable upstreams) as 502.
+// It can be used by handlers of the configuration API as well.
+func WriteError(rw http.ResponseWriter, req *http.Request, err error) {
+	pe, ok := err.(*directors.ProxyError)
+	if !ok && errors.Is(err, context.Canceled) {
+		// nobody is waiting for the response
+		directors.GetRequestInfo(req).ErrorCode = directors.CodeClientClosed
+		rw.WriteHeader(StatusClientClosedRequest)
+		return
+	}
+	if !ok {
+		log.Println(err)
+		if isTimeout(err) {
+			pe = directors.ErrGatewayTimeout("upstream request timed out")
+		} else {
+			pe = directors.NewProxyError(http.StatusBadGateway, directors.CodeBadGateway, "upstream request failed")
+		}
+	}
+
+	directors.GetRequestInfo(req).ErrorCode = pe.Code
+
+	correlationID := pe.CorrelationID
+	if correlationID == "" {
+		correlationID = directors.CorrelationID(req)
+	}
+	if correlationID == "" {
+		correlationID = req.Header.Get(directors.DefaultCorrelationHeader)
+	}
+
+	if pe.RetryAfter > 0 {
+		// in whole seconds, rounded up
+		seconds := int64((pe.RetryAfter + time.Second - 1) / time.Second)
+		rw.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+
+	writeProblem(rw, &problem{
+		Type:          "about:blank",
+		Title:         http.StatusText(pe.StatusCode),
+		Status:        pe.StatusCode,
+		Detail:        pe.Message,
+		Code:          pe.Code,
+		CorrelationID: correlationID,
+	})
+}
+
+// isTimeout reports whether err is caused by a timeout, e.g.
+// the deadline of the request or a connect timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func writeProblem(rw http.ResponseWriter, p *problem) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Println(err)
+		rw.WriteHeader(p.Status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.WriteHeader(p.Status)
+	rw.Write(body)
+}
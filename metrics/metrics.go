@@ -0,0 +1,293 @@
+// Package metrics collects metrics of proxied requests and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the
+// latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestLabels are the labels of the request metrics. The route
+// is the matched route definition, so the number of series doesn't
+// depend on the requested paths.
+type requestLabels struct {
+	route       string
+	upstream    string
+	method      string
+	statusClass string
+}
+
+type errorLabels struct {
+	route string
+	code  string
+}
+
+type cacheLabels struct {
+	route  string
+	status string
+}
+
+type ejectionLabels struct {
+	upstream string
+	target   string
+	reason   string
+}
+
+// Metrics collects the metrics of proxied requests.
+// Register its Observe method as an observer on the
+// ReverseProxy and serve it on the configAPI.
+type Metrics struct {
+	sync.Mutex
+	buckets        []float64
+	requests       map[requestLabels]*histogram
+	rateLimitWaits map[string]*histogram // by route
+	directorErrors map[errorLabels]uint64
+	ejections      map[ejectionLabels]uint64
+	cache          map[cacheLabels]uint64
+}
+
+// New returns an empty Metrics.
+func New() *Metrics {
+	return &Metrics{
+		buckets:        DefaultBuckets,
+		requests:       map[requestLabels]*histogram{},
+		rateLimitWaits: map[string]*histogram{},
+		directorErrors: map[errorLabels]uint64{},
+		ejections:      map[ejectionLabels]uint64{},
+		cache:          map[cacheLabels]uint64{},
+	}
+}
+
+// Observe records a proxied request.
+func (m *Metrics) Observe(info *directors.RequestInfo) {
+	m.Lock()
+	defer m.Unlock()
+
+	labels := requestLabels{
+		route:       info.Route,
+		upstream:    info.Upstream,
+		method:      methodLabel(info.Method),
+		statusClass: statusClass(info.StatusCode),
+	}
+	m.histogram(m.requests, labels).observe(info.Duration)
+
+	if info.RateLimited {
+		h, ok := m.rateLimitWaits[info.Route]
+		if !ok {
+			h = newHistogram(m.buckets)
+			m.rateLimitWaits[info.Route] = h
+		}
+		h.observe(info.RateLimitWait)
+	}
+
+	if info.Rejected {
+		m.directorErrors[errorLabels{route: info.Route, code: info.ErrorCode}]++
+	}
+
+	if info.CacheStatus != "" {
+		m.cache[cacheLabels{route: info.Route, status: info.CacheStatus}]++
+	}
+}
+
+// ObserveEjection records the ejection of an upstream target
+// by outlier detection.
+func (m *Metrics) ObserveEjection(upstream, target, reason string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.ejections[ejectionLabels{upstream: upstream, target: target, reason: reason}]++
+}
+
+func (m *Metrics) histogram(histograms map[requestLabels]*histogram, labels requestLabels) *histogram {
+	h, ok := histograms[labels]
+	if !ok {
+		h = newHistogram(m.buckets)
+		histograms[labels] = h
+	}
+	return h
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	m.Lock()
+	defer m.Unlock()
+
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].String() < requests[j].String()
+	})
+
+	fmt.Fprintln(w, "# HELP proxy_requests_total Number of proxied requests.")
+	fmt.Fprintln(w, "# TYPE proxy_requests_total counter")
+	for _, labels := range requests {
+		fmt.Fprintf(w, "proxy_requests_total{%s} %d\n", labels, m.requests[labels].count)
+	}
+
+	fmt.Fprintln(w, "# HELP proxy_request_duration_seconds Latency of proxied requests.")
+	fmt.Fprintln(w, "# TYPE proxy_request_duration_seconds histogram")
+	for _, labels := range requests {
+		m.requests[labels].write(w, "proxy_request_duration_seconds", labels.String())
+	}
+
+	routes := make([]string, 0, len(m.rateLimitWaits))
+	for route := range m.rateLimitWaits {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# HELP proxy_ratelimit_wait_seconds Time requests spent waiting in rate limiters.")
+	fmt.Fprintln(w, "# TYPE proxy_ratelimit_wait_seconds histogram")
+	for _, route := range routes {
+		m.rateLimitWaits[route].write(w, "proxy_ratelimit_wait_seconds", label("route", route))
+	}
+
+	errs := make([]errorLabels, 0, len(m.directorErrors))
+	for labels := range m.directorErrors {
+		errs = append(errs, labels)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].route != errs[j].route {
+			return errs[i].route < errs[j].route
+		}
+		return errs[i].code < errs[j].code
+	})
+
+	fmt.Fprintln(w, "# HELP proxy_director_errors_total Number of requests rejected by a director.")
+	fmt.Fprintln(w, "# TYPE proxy_director_errors_total counter")
+	for _, labels := range errs {
+		fmt.Fprintf(w, "proxy_director_errors_total{%s,%s} %d\n",
+			label("route", labels.route), label("code", labels.code), m.directorErrors[labels])
+	}
+
+	ejections := make([]ejectionLabels, 0, len(m.ejections))
+	for labels := range m.ejections {
+		ejections = append(ejections, labels)
+	}
+	sort.Slice(ejections, func(i, j int) bool {
+		a, b := ejections[i], ejections[j]
+		if a.upstream != b.upstream {
+			return a.upstream < b.upstream
+		}
+		if a.target != b.target {
+			return a.target < b.target
+		}
+		return a.reason < b.reason
+	})
+
+	fmt.Fprintln(w, "# HELP proxy_upstream_ejections_total Number of upstream targets ejected by outlier detection.")
+	fmt.Fprintln(w, "# TYPE proxy_upstream_ejections_total counter")
+	for _, labels := range ejections {
+		fmt.Fprintf(w, "proxy_upstream_ejections_total{%s,%s,%s} %d\n",
+			label("upstream", labels.upstream), label("target", labels.target), label("reason", labels.reason), m.ejections[labels])
+	}
+
+	cacheRequests := make([]cacheLabels, 0, len(m.cache))
+	for labels := range m.cache {
+		cacheRequests = append(cacheRequests, labels)
+	}
+	sort.Slice(cacheRequests, func(i, j int) bool {
+		if cacheRequests[i].route != cacheRequests[j].route {
+			return cacheRequests[i].route < cacheRequests[j].route
+		}
+		return cacheRequests[i].status < cacheRequests[j].status
+	})
+
+	fmt.Fprintln(w, "# HELP proxy_cache_requests_total Number of requests by response cache status.")
+	fmt.Fprintln(w, "# TYPE proxy_cache_requests_total counter")
+	for _, labels := range cacheRequests {
+		fmt.Fprintf(w, "proxy_cache_requests_total{%s,%s} %d\n",
+			label("route", labels.route), label("status", labels.status), m.cache[labels])
+	}
+}
+
+func (labels requestLabels) String() string {
+	return strings.Join([]string{
+		label("route", labels.route),
+		label("upstream", labels.upstream),
+		label("method", labels.method),
+		label("status", labels.statusClass),
+	}, ",")
+}
+
+// statusClass returns the class of the status code, like "2xx".
+// methodLabel returns the method, or "OTHER" for non-standard
+// methods, so clients can't create any number of series.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE":
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// histogram is a Prometheus histogram of durations.
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (h *histogram) write(w *bufio.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
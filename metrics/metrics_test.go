@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.Observe(&directors.RequestInfo{
+		Method:     "GET",
+		Route:      "/users/:id",
+		Upstream:   "users:8080",
+		StatusCode: 200,
+		Duration:   20 * time.Millisecond,
+	})
+	m.Observe(&directors.RequestInfo{
+		Method:        "GET",
+		Route:         "/users/:id",
+		Upstream:      "users:8080",
+		StatusCode:    204,
+		Duration:      200 * time.Millisecond,
+		RateLimited:   true,
+		RateLimitWait: 150 * time.Millisecond,
+	})
+	m.Observe(&directors.RequestInfo{
+		Method:     "FOO",
+		StatusCode: 405,
+	})
+	m.Observe(&directors.RequestInfo{
+		Method:     "POST",
+		StatusCode: 404,
+		ErrorCode:  directors.CodeInvalidTarget,
+		Rejected:   true,
+	})
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		`proxy_requests_total{route="/users/:id",upstream="users:8080",method="GET",status="2xx"} 2`,
+		`proxy_requests_total{route="",upstream="",method="POST",status="4xx"} 1`,
+		`proxy_requests_total{route="",upstream="",method="OTHER",status="4xx"} 1`,
+		`proxy_request_duration_seconds_bucket{route="/users/:id",upstream="users:8080",method="GET",status="2xx",le="0.025"} 1`,
+		`proxy_request_duration_seconds_bucket{route="/users/:id",upstream="users:8080",method="GET",status="2xx",le="0.25"} 2`,
+		`proxy_request_duration_seconds_count{route="/users/:id",upstream="users:8080",method="GET",status="2xx"} 2`,
+		`proxy_ratelimit_wait_seconds_bucket{route="/users/:id",le="0.1"} 0`,
+		`proxy_ratelimit_wait_seconds_bucket{route="/users/:id",le="0.25"} 1`,
+		`proxy_director_errors_total{route="",code="invalid_target"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing line: %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
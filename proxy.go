@@ -1,36 +1,80 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/zgiber/proxy/breaker"
+	"github.com/zgiber/proxy/cache"
 	"github.com/zgiber/proxy/directors"
 )
 
 type roundTripper struct {
-	rt http.RoundTripper
+	rt       http.RoundTripper
+	breakers atomic.Value // *breaker.Set
+	cached   atomic.Value // *cachedTransport
+
+	mu      sync.Mutex
+	flights map[string]*flight // coalesced requests by key
+}
+
+// cachedTransport is the upstream of a roundTripper wrapped by a cache.
+type cachedTransport struct {
+	http.RoundTripper
 }
 
 // ReverseProxy is the same as httputil.ReverseProxy
 // except that it uses a wrapped Transport, which
-// handles errors created by a Director.
+// handles errors created by a Director. Errors are
+// rendered as application/problem+json responses.
 type ReverseProxy struct {
 	*httputil.ReverseProxy
-	configAPI *http.ServeMux
+	configAPI  *http.ServeMux
+	configAuth atomic.Value // *configAuth
+	observers  []func(info *directors.RequestInfo)
+	transport  *roundTripper
 }
 
 func New() *ReverseProxy {
+	transport := newRoundTripper(newTransport())
 
 	return &ReverseProxy{
-		&httputil.ReverseProxy{
-			Transport: newRoundTripper(http.DefaultTransport),
+		ReverseProxy: &httputil.ReverseProxy{
+			Transport:    transport,
+			ErrorHandler: WriteError,
 		},
-		http.NewServeMux(),
+		configAPI: http.NewServeMux(),
+		transport: transport,
+	}
+}
+
+// SetCache serves the responses of the upstreams from the cache,
+// nil disables caching.
+func (rp *ReverseProxy) SetCache(c *cache.Cache) {
+	if c == nil {
+		rp.transport.cached.Store((*cachedTransport)(nil))
+		return
 	}
+	rp.transport.cached.Store(&cachedTransport{c.Wrap(roundTripperFunc(rp.transport.upstream))})
+}
+
+// SetCircuitBreakers guards the round trips to every upstream host
+// with a circuit breaker of the set, nil disables them. Requests to
+// hosts with an open breaker fail fast with 503 and Retry-After.
+func (rp *ReverseProxy) SetCircuitBreakers(breakers *breaker.Set) {
+	rp.transport.breakers.Store(breakers)
 }
 
 // AddDirector registers a director to be chained after the existing
@@ -48,6 +92,52 @@ func (rp *ReverseProxy) AddDirector(director func(req *http.Request)) {
 	rp.Director = directors.Chain(rp.Director, director)
 }
 
+// AddObserver registers a function which is called with the
+// RequestInfo of every proxied request after the response
+// is written to the client (e.g. for access logs).
+func (rp *ReverseProxy) AddObserver(observer func(info *directors.RequestInfo)) {
+	if observer == nil {
+		log.Fatal("observer must be non nil")
+	}
+
+	rp.observers = append(rp.observers, observer)
+}
+
+// ServeHTTP proxies the request and reports its RequestInfo
+// to the observers.
+func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	info := directors.NewRequestInfo(req)
+	rec := &responseRecorder{ResponseWriter: rw, info: info}
+
+	rp.ReverseProxy.ServeHTTP(rec, directors.WithRequestInfo(req, info))
+
+	info.StatusCode = rec.statusCode
+	info.BytesWritten = rec.bytesWritten
+	info.Duration = time.Since(info.Start)
+	info.Done()
+
+	for _, observer := range rp.observers {
+		observer(info)
+	}
+}
+
+// AddResponseModifier registers a response modifier to be chained
+// after the existing ones. Modifiers are called with the upstream
+// response before it is copied to the client, resp.Request is the
+// request prepared by the directors.
+func (rp *ReverseProxy) AddResponseModifier(modifier func(resp *http.Response) error) {
+	if modifier == nil {
+		log.Fatal("response modifier must be non nil")
+	}
+
+	if rp.ModifyResponse == nil {
+		rp.ModifyResponse = modifier
+		return
+	}
+
+	rp.ModifyResponse = directors.ChainResponse(rp.ModifyResponse, modifier)
+}
+
 // AddDynamicDirector registers a director on the reverseproxy and
 // registers the given http.Handlers on the configAPI http server.
 // This way we can provide a http configuration interface for
@@ -61,29 +151,448 @@ func (rp *ReverseProxy) AddDynamicDirector(
 	rp.Director = directors.Chain(rp.Director, director)
 }
 
+// HandleConfig registers a handler on the configAPI http server
+// without adding a director.
+func (rp *ReverseProxy) HandleConfig(pattern string, handler http.Handler) {
+	rp.configAPI.Handle(pattern, handler)
+}
+
+// ConfigAPI returns the http.Handler of the configuration interface.
+func (rp *ReverseProxy) ConfigAPI() http.Handler {
+	return http.HandlerFunc(rp.serveConfig)
+}
+
 // ListenAndServeDirectorConfig starts the http server for the configuration
 // interface on the given addr.
 func (rp *ReverseProxy) ListenAndServeDirectorConfig(addr string) error {
-	return http.ListenAndServe(addr, rp.configAPI)
+	return http.ListenAndServe(addr, rp.ConfigAPI())
 }
 
 // ListenAndServeDirectorConfigTLS starts the https server for the configuration
 // interface on the given addr.
 func (rp *ReverseProxy) ListenAndServeDirectorConfigTLS(addr, certFile, keyFile string) error {
-	return http.ListenAndServeTLS(addr, certFile, keyFile, rp.configAPI)
+	return http.ListenAndServeTLS(addr, certFile, keyFile, rp.ConfigAPI())
+}
+
+// ListenAndServeDirectorConfigMutualTLS starts the https server for the
+// configuration interface on the given addr. Client certificates are
+// verified against the CA certificates in clientCAFile, so clients can
+// be authenticated with auth.NewClientCertAuthenticator.
+func (rp *ReverseProxy) ListenAndServeDirectorConfigMutualTLS(addr, certFile, keyFile, clientCAFile string) error {
+	caCerts, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return err
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCerts) {
+		return fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: rp.ConfigAPI(),
+		TLSConfig: &tls.Config{
+			ClientCAs: clientCAs,
+			// clients without certificates may use other authenticators
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		},
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// newTransport returns a copy of http.DefaultTransport which
+// applies the connect timeout of the route to new connections.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if timeouts, ok := directors.TimeoutsFromContext(ctx); ok && timeouts.Connect > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeouts.Connect)
+			defer cancel()
+		}
+		return dial(ctx, network, addr)
+	}
+	return transport
+}
+
+func newRoundTripper(t http.RoundTripper) *roundTripper {
+	rt := &roundTripper{rt: t, flights: map[string]*flight{}}
+	rt.breakers.Store((*breaker.Set)(nil))
+	rt.cached.Store((*cachedTransport)(nil))
+	return rt
 }
 
-func newRoundTripper(t http.RoundTripper) http.RoundTripper {
-	return &roundTripper{t}
+// roundTripperFunc is an adapter to use ordinary
+// functions as http.RoundTrippers.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	fmt.Printf("% v", req)
 	if ctx := req.Context(); ctx.Err() != nil {
+		// answered by a director
+		if resp, ok := ctx.Value("response").(*http.Response); ok {
+			resp.Request = req
+			return resp, nil
+		}
+
+		// cancelled by a director, not by the client
+		if _, ok := ctx.Value("error").(error); ok {
+			directors.GetRequestInfo(req).Rejected = true
+		}
 		return nil, errorFromContext(ctx)
-		// TODO: return appropriate responses for certain errors
 	}
-	return rt.rt.RoundTrip(req)
+
+	if cached := rt.cached.Load().(*cachedTransport); cached != nil {
+		return cached.RoundTrip(req)
+	}
+	return rt.upstream(req)
+}
+
+// upstream sends the request upstream, coalesced with identical
+// concurrent requests if the route asks for it.
+func (rt *roundTripper) upstream(req *http.Request) (*http.Response, error) {
+	if policy, ok := directors.GetCoalescePolicy(req); ok {
+		return rt.coalesce(req, policy)
+	}
+	return rt.dispatch(req)
+}
+
+// dispatch sends the request upstream, with retries
+// if the route asks for them.
+func (rt *roundTripper) dispatch(req *http.Request) (*http.Response, error) {
+	if policy, ok := directors.GetRetryPolicy(req); ok {
+		return rt.retry(req, policy)
+	}
+	return rt.attempt(req)
+}
+
+// attempt sends the request upstream, hedged if the route asks for it.
+func (rt *roundTripper) attempt(req *http.Request) (*http.Response, error) {
+	if policy, ok := directors.GetHedgePolicy(req); ok {
+		return rt.hedge(req, policy)
+	}
+	return rt.roundTrip(req)
+}
+
+// roundTrip sends the request upstream once and records
+// the time spent upstream in the RequestInfo.
+func (rt *roundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	info := directors.GetRequestInfo(req)
+	if info.UpstreamStart.IsZero() {
+		info.UpstreamStart = time.Now()
+	}
+	setDeadlineHeader(req)
+	resp, _, err := rt.send(req)
+	info.UpstreamDuration = time.Since(info.UpstreamStart)
+	return resp, err
+}
+
+// send sends the request upstream through the circuit breaker of
+// the host, and reports the result to the breaker and the outlier
+// detection. It doesn't change the RequestInfo, so it can be
+// called concurrently for the same request.
+func (rt *roundTripper) send(req *http.Request) (*http.Response, time.Duration, error) {
+	done := func(breaker.Outcome) {}
+	if breakers := rt.breakers.Load().(*breaker.Set); breakers != nil {
+		allowed, retryAfter, ok := breakers.Get(req.URL.Host).Allow()
+		if !ok {
+			pe := directors.ErrServiceUnavailable("circuit breaker is open")
+			pe.Code = directors.CodeCircuitOpen
+			pe.RetryAfter = retryAfter
+			return nil, 0, pe
+		}
+		done = allowed
+	}
+
+	// cancelled by the client (or by hedge), it says
+	// nothing about the upstream
+	ctx := req.Context()
+	cancelled := func() bool { return ctx.Err() == context.Canceled }
+
+	start := time.Now()
+	resp, err := rt.roundTripWithHeaderTimeout(req)
+	latency := time.Since(start)
+
+	switch {
+	case cancelled():
+		done(breaker.Ignored)
+	case err != nil || resp.StatusCode >= 500:
+		done(breaker.Failure)
+	default:
+		done(breaker.Success)
+	}
+
+	// report to the outlier detection of the load balancer, unless
+	// the request ran out of the Total timeout of its route
+	timedOut := err != nil && ctx.Err() == context.DeadlineExceeded
+	if target, ok := directors.UpstreamTarget(req); ok && !cancelled() && !timedOut {
+		target.Observe(resp, err, latency)
+	}
+	return resp, latency, err
+}
+
+// roundTripWithHeaderTimeout sends the request upstream, cancelling
+// it if the response headers don't arrive within the ResponseHeader
+// timeout of the route.
+func (rt *roundTripper) roundTripWithHeaderTimeout(req *http.Request) (*http.Response, error) {
+	timeouts, ok := directors.GetTimeouts(req)
+	if !ok || timeouts.ResponseHeader <= 0 {
+		return rt.rt.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeouts.ResponseHeader, cancel)
+
+	resp, err := rt.rt.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the request must not be cancelled until the body is read
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// errResponseHeaderTimeout is returned if the upstream doesn't send
+// the response headers in time. It's a net.Error, so it's retried
+// like other connection errors and reported as 504.
+var errResponseHeaderTimeout error = &timeoutError{"timeout awaiting response headers"}
+
+type timeoutError struct {
+	message string
+}
+
+func (e *timeoutError) Error() string   { return e.message }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// setDeadlineHeader sends the time remaining until the deadline
+// of the request to the upstream, if the route asks for it.
+func setDeadlineHeader(req *http.Request) {
+	if timeouts, ok := directors.GetTimeouts(req); ok {
+		timeouts.SetDeadlineHeader(req)
+	}
+}
+
+// hedge sends the request upstream, and if it hasn't responded
+// within the delay of the policy, sends it to another target of
+// the pool as well. The first response is used, the other request
+// is cancelled.
+func (rt *roundTripper) hedge(req *http.Request, policy *directors.HedgePolicy) (*http.Response, error) {
+	info := directors.GetRequestInfo(req)
+	if info.UpstreamStart.IsZero() {
+		info.UpstreamStart = time.Now()
+	}
+	defer func() {
+		info.UpstreamDuration = time.Since(info.UpstreamStart)
+	}()
+
+	if policy.Budget != nil {
+		policy.Budget.Request()
+	}
+
+	results := make(chan hedgeResult, 2)
+	cancels := map[*http.Request]context.CancelFunc{}
+	start := func(req *http.Request) {
+		setDeadlineHeader(req)
+		ctx, cancel := context.WithCancel(req.Context())
+		req = req.WithContext(ctx)
+		cancels[req] = cancel
+		go func() {
+			resp, latency, err := rt.send(req)
+			if err == nil && ctx.Err() == nil {
+				policy.Observe(latency)
+			}
+			results <- hedgeResult{req, resp, err}
+		}()
+	}
+
+	start(req)
+	pending := 1
+
+	var timeout <-chan time.Time
+	if delay, ok := policy.Delay(); ok && (req.Body == nil || req.Body == http.NoBody) {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var winner hedgeResult
+	select {
+	case winner = <-results:
+		pending--
+
+	case <-timeout:
+		upstream := info.Upstream
+		if policy.Budget == nil || policy.Budget.Withdraw() {
+			if hedged, ok := directors.Hedge(req); ok {
+				start(hedged)
+				pending++
+				info.Hedged = true
+			}
+		}
+		// changed by directing the hedged request
+		info.Upstream = upstream
+
+		winner = <-results
+		pending--
+	}
+
+	// wait for the other request if the first one failed
+	if winner.err != nil && pending > 0 {
+		winner = <-results
+		pending--
+	}
+
+	// cancel the other request, its response is discarded
+	for req, cancel := range cancels {
+		if req != winner.req {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		go func() {
+			if loser := <-results; loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+		}()
+	}
+
+	info.Upstream = winner.req.URL.Host
+	if winner.err != nil {
+		cancels[winner.req]()
+		return nil, winner.err
+	}
+
+	// the request must not be cancelled until the body is read
+	winner.resp.Body = &cancelOnClose{winner.resp.Body, cancels[winner.req]}
+	return winner.resp, nil
+}
+
+// hedgeResult is the result of a request sent by hedge.
+type hedgeResult struct {
+	req  *http.Request
+	resp *http.Response
+	err  error
+}
+
+// cancelOnClose cancels the context of a request
+// when the body of its response is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retry sends the request and resends it according to the policy.
+// The body is buffered so it can be resent, requests with bodies
+// over the limit of the policy are sent once.
+func (rt *roundTripper) retry(req *http.Request, policy *directors.RetryPolicy) (*http.Response, error) {
+	if policy.Budget != nil {
+		policy.Budget.Request()
+	}
+	if !policy.Retryable(req) {
+		return rt.attempt(req)
+	}
+
+	body, complete, err := bufferBody(req, policy.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return rt.attempt(req)
+	}
+
+	info := directors.GetRequestInfo(req)
+	for n := 0; ; n++ {
+		attempt := req
+		if body != nil {
+			attempt = req.Clone(req.Context())
+			attempt.Body, _ = attempt.GetBody()
+		}
+
+		resp, err := rt.attempt(attempt)
+		if n == policy.MaxRetries || !shouldRetry(req, policy, resp, err) {
+			return resp, err
+		}
+		if policy.Budget != nil && !policy.Budget.Withdraw() {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(policy.Backoff(n + 1))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		info.Retries++
+	}
+}
+
+// shouldRetry reports whether the result of an attempt is retried.
+func shouldRetry(req *http.Request, policy *directors.RetryPolicy, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		// errors of the proxy (e.g. an open circuit breaker) are final
+		_, ok := err.(*directors.ProxyError)
+		return !ok
+	}
+	return policy.RetryStatus(resp.StatusCode)
+}
+
+// bufferBody reads the body of the request, so it can be resent
+// with req.GetBody. If the body is larger than limit, the request
+// is left with its original body and complete is false.
+func bufferBody(req *http.Request, limit int64) (body []byte, complete bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	body, err = ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return body, true, nil
 }
 
 func errorFromContext(ctx context.Context) error {
@@ -92,6 +601,46 @@ func errorFromContext(ctx context.Context) error {
 	case error:
 		return err
 	default:
-		return errors.New("context expired") // TODO come up with something neater
+		// cancelled by the client or timed out
+		return ctx.Err()
+	}
+}
+
+// responseRecorder records the status code and the
+// number of bytes written to the client. It applies the
+// response headers of the directors to the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	info         *directors.RequestInfo
+	statusCode   int
+	bytesWritten int64
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.statusCode == 0 {
+		rec.statusCode = statusCode
+		rec.info.WriteResponseHeader(rec.ResponseWriter.Header())
 	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytesWritten += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach
+// the original ResponseWriter (e.g. for hijacking).
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
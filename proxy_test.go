@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zgiber/proxy/breaker"
+	"github.com/zgiber/proxy/directors"
+)
+
+func TestDirectorErrorResponses(t *testing.T) {
+
+	tests := []struct {
+		err            error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{directors.ErrNotFound("not found"), http.StatusNotFound, directors.CodeNotFound},
+		{directors.ErrUnauthorized("missing token"), http.StatusUnauthorized, directors.CodeUnauthorized},
+		{directors.ErrTooManyRequests("slow down"), http.StatusTooManyRequests, directors.CodeTooManyRequests},
+		{directors.ErrServiceUnavailable("down"), http.StatusServiceUnavailable, directors.CodeServiceUnavailable},
+	}
+
+	for i, test := range tests {
+		err := test.err
+		rp := New()
+		rp.AddDirector(func(req *http.Request) {
+			req.Header.Set("X-Correlation-ID", "abc123")
+			directors.CancelRequestWithError(req, err)
+		})
+
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+
+		if rec.Code != test.expectedStatus {
+			t.Fatalf("[%v] Invalid status. Expected:%v Got:%v", i, test.expectedStatus, rec.Code)
+		}
+
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("[%v] Invalid content type: %v", i, ct)
+		}
+
+		p := problem{}
+		if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Status != test.expectedStatus || p.Code != test.expectedCode || p.CorrelationID != "abc123" {
+			t.Fatalf("[%v] Invalid problem: %+v", i, p)
+		}
+	}
+}
+
+func TestUpstreamErrorResponse(t *testing.T) {
+	rp := New()
+	rp.AddDirector(directors.NewSingleHost("http://127.0.0.1:1"))
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("Invalid status. Expected:%v Got:%v", http.StatusBadGateway, rec.Code)
+	}
+}
+
+func TestClientClosedRequest(t *testing.T) {
+	rp := New()
+	rp.AddDirector(directors.NewSingleHost("http://127.0.0.1:1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil).WithContext(ctx))
+
+	if rec.Code != StatusClientClosedRequest || rec.Body.Len() != 0 {
+		t.Fatalf("Invalid response. Expected:%v without body Got:%v %q", StatusClientClosedRequest, rec.Code, rec.Body)
+	}
+}
+
+func TestResponseModifiers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Server", "upstream")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	rp := New()
+	rp.AddDirector(directors.NewRouter(map[string]func(*http.Request){
+		"/users/:user_id": directors.NewSingleHost(upstream.URL),
+	}))
+
+	rp.AddResponseModifier(func(resp *http.Response) error {
+		resp.Header.Del("Server")
+		return nil
+	})
+	rp.AddResponseModifier(func(resp *http.Response) error {
+		resp.Header.Set("X-Route", directors.MatchedRoute(resp.Request))
+		resp.Header.Set("X-User", directors.PathVariable(resp.Request, "user_id"))
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/users/user123", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Invalid status. Expected:%v Got:%v", http.StatusOK, rec.Code)
+	}
+
+	if server := rec.Header().Get("Server"); server != "" {
+		t.Fatalf("Server header not removed: %v", server)
+	}
+
+	if route := rec.Header().Get("X-Route"); route != "/users/:user_id" {
+		t.Fatalf("Invalid route. Expected:%v Got:%v", "/users/:user_id", route)
+	}
+
+	if user := rec.Header().Get("X-User"); user != "user123" {
+		t.Fatalf("Invalid path variable. Expected:%v Got:%v", "user123", user)
+	}
+}
+
+func TestCorrelationEcho(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("X-Request-ID")))
+	}))
+	defer upstream.Close()
+
+	correlation, err := directors.NewCorrelationWithOptions(directors.CorrelationOptions{
+		Header:        "X-Request-ID",
+		TrustIncoming: true,
+		Echo:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/ok", "/forbidden"} {
+		rp := New()
+		rp.AddDirector(directors.Chain(correlation, func(req *http.Request) {
+			if req.URL.Path == "/forbidden" {
+				directors.CancelRequestWithError(req, directors.ErrForbidden("no"))
+				return
+			}
+			directors.NewSingleHost(upstream.URL)(req)
+		}))
+
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		req.Header.Set("X-Request-ID", "client-id.1")
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, req)
+
+		if id := rec.Header().Get("X-Request-ID"); id != "client-id.1" {
+			t.Fatalf("[%v] Expected the ID to be echoed, got %q", path, id)
+		}
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	working := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer working.Close()
+
+	failingTarget, _ := directors.NewTarget(failing.URL, 1)
+	workingTarget, _ := directors.NewTarget(working.URL, 1)
+	lb := directors.NewLoadBalancer([]*directors.Target{failingTarget, workingTarget}, directors.RoundRobin())
+	lb.DetectOutliers(directors.OutlierDetection{Consecutive5xx: 2})
+
+	rp := New()
+	rp.AddDirector(lb.Direct)
+
+	statuses := []int{}
+	for i := 0; i < 8; i++ {
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+		statuses = append(statuses, rec.Code)
+	}
+
+	if !failingTarget.Ejected() {
+		t.Fatal("Expected the failing target to be ejected")
+	}
+	for _, status := range statuses[4:] {
+		if status != http.StatusOK {
+			t.Fatalf("Expected only the working target after the ejection, got %v", statuses)
+		}
+	}
+}
+
+func TestOutlierDetectionTotalTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	targets := []*directors.Target{}
+	for i := 0; i < 2; i++ {
+		target, _ := directors.NewTarget(slow.URL, 1)
+		targets = append(targets, target)
+	}
+	lb := directors.NewLoadBalancer(targets, directors.RoundRobin())
+	lb.DetectOutliers(directors.OutlierDetection{ConsecutiveErrors: 1})
+
+	rp := New()
+	rp.AddDirector(directors.Chain(directors.NewTimeouts(directors.Timeouts{Total: 10 * time.Millisecond}), lb.Direct))
+
+	// the route's own timeout says nothing about the target
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("Expected 504, got %v", rec.Code)
+		}
+	}
+	for _, target := range targets {
+		if target.Ejected() {
+			t.Fatal("Unexpected ejection after the Total timeout")
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	rp := New()
+	rp.AddDirector(directors.NewSingleHost(failing.URL))
+	rp.SetCircuitBreakers(breaker.NewSet(breaker.Settings{ConsecutiveFailures: 2, OpenTimeout: time.Minute}))
+
+	statuses := []int{}
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+		statuses = append(statuses, rec.Code)
+	}
+
+	if statuses[0] != http.StatusInternalServerError || statuses[1] != http.StatusInternalServerError {
+		t.Fatalf("Expected the upstream responses before the breaker opens, got %v", statuses)
+	}
+	if statuses[2] != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while the breaker is open, got %v", statuses)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Fatalf("Expected Retry-After: 60, got %q", retryAfter)
+	}
+	if !strings.Contains(rec.Body.String(), directors.CodeCircuitOpen) {
+		t.Fatalf("Expected %s in the body, got %s", directors.CodeCircuitOpen, rec.Body.String())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write(body)
+	}))
+	defer upstream.Close()
+
+	rp := New()
+	rp.AddDirector(directors.NewRetry(directors.RetryPolicy{
+		StatusCodes: []int{http.StatusServiceUnavailable},
+		BaseBackoff: time.Millisecond,
+	}))
+	rp.AddDirector(directors.NewSingleHost(upstream.URL))
+
+	// the body is resent
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "http://localhost/", strings.NewReader("hello"))
+	rp.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" || atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("Expected success after 3 attempts, got %v %q after %v", rec.Code, rec.Body.String(), attempts)
+	}
+
+	// POST without Idempotency-Key is not retried
+	atomic.StoreInt32(&attempts, 0)
+	rec = httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/", strings.NewReader("hello")))
+	if rec.Code != http.StatusServiceUnavailable || atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("Expected a single attempt, got %v after %v", rec.Code, attempts)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+		rw.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	slowTarget, _ := directors.NewTarget(slow.URL, 1)
+	fastTarget, _ := directors.NewTarget(fast.URL, 1)
+	lb := directors.NewLoadBalancer([]*directors.Target{slowTarget, fastTarget}, directors.RoundRobin())
+
+	hedge := directors.NewHedge(directors.HedgePolicy{MinSamples: 1})
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	hedge(req)
+	policy, _ := directors.GetHedgePolicy(req)
+	policy.Observe(10 * time.Millisecond)
+
+	rp := New()
+	rp.AddDirector(hedge)
+	rp.AddDirector(lb.Direct)
+
+	var info *directors.RequestInfo
+	rp.AddObserver(func(i *directors.RequestInfo) { info = i })
+
+	// the first request goes to the slow target
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+
+	if rec.Body.String() != "fast" || !info.Hedged {
+		t.Fatalf("Expected the hedged response, got %q", rec.Body.String())
+	}
+	if info.Duration > 500*time.Millisecond {
+		t.Fatalf("Expected the slow request to be cancelled, took %v", info.Duration)
+	}
+	if info.Upstream != fastTarget.URL.Host {
+		t.Fatalf("Expected upstream %s, got %s", fastTarget.URL.Host, info.Upstream)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	deadlines := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		deadlines <- req.Header.Get("X-Request-Deadline")
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	rp := New()
+	rp.AddDirector(directors.NewTimeouts(directors.Timeouts{
+		ResponseHeader: 50 * time.Millisecond,
+		Total:          200 * time.Millisecond,
+		DeadlineHeader: "X-Request-Deadline",
+	}))
+	rp.AddDirector(directors.NewSingleHost(upstream.URL))
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), directors.CodeGatewayTimeout) {
+		t.Fatalf("Expected 504, got %v %s", rec.Code, rec.Body.String())
+	}
+
+	deadline, _ := strconv.Atoi(<-deadlines)
+	if deadline <= 100 || deadline > 200 {
+		t.Fatalf("Expected the remaining milliseconds in the deadline header, got %v", deadline)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		if req.URL.Query().Get("cookie") != "" {
+			rw.Header().Set("Set-Cookie", "session="+strconv.Itoa(int(n)))
+		}
+		rw.Write([]byte("response " + strconv.Itoa(int(n))))
+	}))
+	defer upstream.Close()
+
+	rp := New()
+	rp.AddDirector(directors.NewCoalesce(directors.CoalescePolicy{}))
+	rp.AddDirector(directors.NewSingleHost(upstream.URL))
+
+	var coalesced int32
+	rp.AddObserver(func(info *directors.RequestInfo) {
+		if info.Coalesced {
+			atomic.AddInt32(&coalesced, 1)
+		}
+	})
+
+	serve := func(url string, n int) []string {
+		bodies := make(chan string, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				rec := httptest.NewRecorder()
+				rp.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+				bodies <- rec.Body.String()
+			}()
+		}
+
+		responses := []string{}
+		for i := 0; i < n; i++ {
+			responses = append(responses, <-bodies)
+		}
+		return responses
+	}
+
+	for _, body := range serve("http://localhost/", 5) {
+		if body != "response 1" {
+			t.Fatalf("Expected the shared response, got %q", body)
+		}
+	}
+	if requests != 1 || coalesced != 4 {
+		t.Fatalf("Expected 1 upstream request for 5 requests, got %v (%v coalesced)", requests, coalesced)
+	}
+
+	// responses setting cookies are not shared
+	atomic.StoreInt32(&requests, 0)
+	serve("http://localhost/?cookie=1", 3)
+	if requests != 3 {
+		t.Fatalf("Expected 3 upstream requests, got %v", requests)
+	}
+}
+
+func TestDirectorResponse(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Header().Set("Vary", "Accept-Encoding")
+	}))
+	defer upstream.Close()
+
+	rp := New()
+	cors, err := directors.NewCORS(directors.CORSPolicy{AllowedOrigins: []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.AddDirector(cors)
+	rp.AddDirector(directors.NewSingleHost(upstream.URL))
+
+	req := httptest.NewRequest("OPTIONS", "http://localhost/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Fatalf("Expected the preflight response, got %v %v", rec.Code, rec.Header())
+	}
+	if requests != 0 {
+		t.Fatal("Expected the preflight request not to be sent upstream")
+	}
+
+	// the headers of directors are added to the response of the upstream
+	req = httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rec = httptest.NewRecorder()
+	rp.ServeHTTP(rec, req)
+
+	if vary := rec.Header()["Vary"]; len(vary) != 2 || rec.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatalf("Expected the CORS headers on the upstream response, got %v", rec.Header())
+	}
+}
@@ -1,39 +1,75 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/zgiber/proxy"
-	"github.com/zgiber/proxy/directors"
+	"github.com/zgiber/proxy/config"
 )
 
 func main() {
-	reverseProxy := proxy.New()
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
 
-	// Global stuff
-	reverseProxy.AddDirector(directors.Chain(
-		directors.NewRateLimiter(100*time.Millisecond, 30*time.Second, 10), // delay (between calls), burst timeout, number of burst calls
-		directors.NewCorrelation(),
-	))
+	configPath := flag.String("config", "proxy.yaml", "path of the configuration file (YAML or JSON)")
+	flag.Parse()
+
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// routed endpoints
-	// TODO: use * wildcard match
-	targets := map[string]func(*http.Request){
-		"/hello":                 directors.NewSingleHost("http://localhost:8080/mypath"),    // start something on port 8080 first... (python -m SimpleHTTPServer 8080)
-		"/api/:user_id/profile":  directors.NewSingleHost("http://localhost:8081"),           // note the lack of '/' in the end.. this will not change paths, just host and scheme
-		"/api/:user_id/profile2": directors.NewSingleHost("http://localhost:8081/"),          // just an idea.. disregard for now
-		"/api/:user_id/*":        directors.NewSingleHost("http://localhost:8081/whatevers"), // just an idea.. disregard for now
+	manager, err := config.NewManager(*configPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// add router director
-	reverseProxy.AddDirector(directors.NewRouter(targets))
+	// reload on changes of the file and on SIGHUP
+	go manager.Watch(2*time.Second, nil)
+
+	cfg := manager.Config()
+	reverseProxy := manager.Proxy()
 
 	// start configuration backend
-	go reverseProxy.ListenAndServeDirectorConfig(":9002") // TODO: add some resilience to the config backend
+	if cfg.Listen.Admin != "" {
+		go serveConfig(reverseProxy, cfg) // TODO: add some resilience to the config backend
+	}
+
+	// record traffic for replaying it later
+	var handler http.Handler = reverseProxy
+	recorder, err := config.OpenCapture(cfg.Capture)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if recorder != nil {
+		handler = recorder.Handler(handler)
+	}
 
 	// start proxy
-	http.ListenAndServe(":9001", reverseProxy)
+	if tls := cfg.Listen.TLS; tls != nil {
+		log.Fatal(http.ListenAndServeTLS(cfg.Listen.Proxy, tls.CertFile, tls.KeyFile, handler))
+	}
+	log.Fatal(http.ListenAndServe(cfg.Listen.Proxy, handler))
+}
+
+func serveConfig(reverseProxy *proxy.ReverseProxy, cfg *config.Config) {
+	if cfg.Admin.Auth == nil {
+		if !cfg.Admin.Insecure {
+			log.Fatal("configuration API requires admin.auth, or admin.insecure to serve it without authentication")
+		}
+		log.Println("configuration API is served without authentication")
+	}
+
+	var err error
+	switch tls := cfg.Admin.TLS; {
+	case tls == nil:
+		err = reverseProxy.ListenAndServeDirectorConfig(cfg.Listen.Admin)
+	case tls.ClientCAFile != "":
+		err = reverseProxy.ListenAndServeDirectorConfigMutualTLS(cfg.Listen.Admin, tls.CertFile, tls.KeyFile, tls.ClientCAFile)
+	default:
+		err = reverseProxy.ListenAndServeDirectorConfigTLS(cfg.Listen.Admin, tls.CertFile, tls.KeyFile)
+	}
+	log.Println(err)
 }
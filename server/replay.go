@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/zgiber/proxy/capture"
+)
+
+// replay is the "replay" command. It replays a capture file
+// against a target and reports the differences.
+//
+//	server replay -capture traffic.jsonl -target http://localhost:9001
+func replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	capturePath := flags.String("capture", "", "path of the capture file")
+	target := flags.String("target", "http://localhost:9001", "base URL the requests are sent to")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of a single request")
+	flags.Parse(args)
+
+	if *capturePath == "" {
+		flags.Usage()
+		return 2
+	}
+
+	file, err := os.Open(*capturePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	results, err := capture.Replay(file, *target, &http.Client{
+		Timeout: *timeout,
+		// report redirects as recorded instead of following them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	var failed int
+	for _, result := range results {
+		if result.Error == "" && result.StatusMatch && result.BodyMatch {
+			continue
+		}
+		failed++
+
+		switch {
+		case result.Error != "":
+			fmt.Printf("ERROR %s %s: %s\n", result.Method, result.URL, result.Error)
+		case !result.StatusMatch:
+			fmt.Printf("STATUS %s %s: recorded %d, got %d\n", result.Method, result.URL, result.RecordedStatus, result.Status)
+		default:
+			fmt.Printf("BODY %s %s: response body differs\n", result.Method, result.URL)
+		}
+	}
+
+	var recordedLatency, latency float64
+	for _, result := range results {
+		recordedLatency += result.RecordedLatencyMs
+		latency += result.LatencyMs
+	}
+	if len(results) > 0 {
+		recordedLatency /= float64(len(results))
+		latency /= float64(len(results))
+	}
+
+	fmt.Printf("%d requests replayed, %d differ, average latency %.1fms (recorded %.1fms)\n",
+		len(results), failed, latency, recordedLatency)
+
+	if failed > 0 || err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+// Package tracing propagates W3C Trace Context headers and
+// exports the spans of proxied requests to an OTLP/HTTP collector.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// Director continues the trace of the incoming traceparent header
+// or starts a new trace if it's missing or invalid. The span of the
+// proxied request is stored in the RequestInfo, the upstream receives
+// a traceparent with a child span of it. The tracestate header is
+// passed on unchanged as long as the trace is continued.
+func Director(req *http.Request) {
+	trace := &directors.TraceContext{Sampled: true}
+
+	traceID, parentID, sampled, ok := parseTraceParent(req.Header.Get("traceparent"))
+	if ok {
+		trace.TraceID, trace.ParentSpanID, trace.Sampled = traceID, parentID, sampled
+	} else {
+		trace.TraceID = newID(16)
+		req.Header.Del("tracestate")
+	}
+
+	trace.SpanID = newID(8)
+	trace.UpstreamSpanID = newID(8)
+
+	req.Header.Set("traceparent", formatTraceParent(trace.TraceID, trace.UpstreamSpanID, trace.Sampled))
+	directors.GetRequestInfo(req).Trace = trace
+}
+
+// parseTraceParent parses a traceparent header:
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+// Headers of future versions are accepted as long as they start
+// with the fields of version 00.
+func parseTraceParent(header string) (traceID, parentID string, sampled, ok bool) {
+	header = strings.TrimSpace(header)
+	if len(header) < 55 || (len(header) > 55 && header[55] != '-') {
+		return "", "", false, false
+	}
+
+	version, traceID, parentID, flags := header[0:2], header[3:35], header[36:52], header[53:55]
+	if header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return "", "", false, false
+	}
+
+	if !isHex(version) || version == "ff" || (version == "00" && len(header) != 55) {
+		return "", "", false, false
+	}
+
+	if !isHex(traceID) || isZero(traceID) || !isHex(parentID) || isZero(parentID) || !isHex(flags) {
+		return "", "", false, false
+	}
+
+	flagBits, _ := hex.DecodeString(flags)
+	return traceID, parentID, flagBits[0]&1 == 1, true
+}
+
+func formatTraceParent(traceID, spanID string, sampled bool) string {
+	flags := "00"
+	if sampled {
+		flags = "01"
+	}
+	return "00-" + traceID + "-" + spanID + "-" + flags
+}
+
+// isHex reports whether s consists of lowercase hex digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// newID returns a random ID of n bytes in hex.
+func newID(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		log.Println(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,301 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zgiber/proxy/directors"
+)
+
+// OTLP span kinds and status codes.
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+
+	statusError = 2
+)
+
+// Options configure a Tracer.
+type Options struct {
+	// Collector is the OTLP/HTTP traces endpoint,
+	// e.g. http://localhost:4318/v1/traces.
+	Collector   string
+	ServiceName string
+
+	// Spans are sent in batches of BatchSize (default 256),
+	// or after FlushInterval (default 5s).
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// Client sends the spans (default a client with a 10s timeout,
+	// so a slow collector can't hold up the export).
+	Client *http.Client
+}
+
+// Tracer exports the spans of proxied requests. Register the
+// package level Director in the director chain and Observe as an
+// observer on the ReverseProxy. Spans are exported in the background,
+// they are dropped if the collector can't keep up.
+type Tracer struct {
+	options Options
+	spans   chan *span
+
+	sync.RWMutex // guards closed
+	closed       bool
+	done         chan struct{}
+}
+
+// NewTracer returns a Tracer exporting to options.Collector.
+// It must be closed to flush the buffered spans.
+func NewTracer(options Options) *Tracer {
+	if options.ServiceName == "" {
+		options.ServiceName = "proxy"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 256
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = 5 * time.Second
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	t := &Tracer{
+		options: options,
+		spans:   make(chan *span, 4*options.BatchSize),
+		done:    make(chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// Observe exports the spans of a sampled request: the span of
+// the proxied request and its children for the time spent in
+// the directors and waiting for the upstream.
+func (t *Tracer) Observe(info *directors.RequestInfo) {
+	trace := info.Trace
+	if trace == nil || !trace.Sampled {
+		return
+	}
+
+	end := info.Start.Add(info.Duration)
+	directorsEnd := end
+	if !info.UpstreamStart.IsZero() {
+		directorsEnd = info.UpstreamStart
+	}
+
+	name := info.Method
+	if info.Route != "" {
+		name += " " + info.Route
+	}
+
+	server := &span{
+		TraceID:      trace.TraceID,
+		SpanID:       trace.SpanID,
+		ParentSpanID: trace.ParentSpanID,
+		Name:         name,
+		Kind:         kindServer,
+		Start:        unixNano(info.Start),
+		End:          unixNano(end),
+		Attributes: []attribute{
+			stringAttribute("http.request.method", info.Method),
+			stringAttribute("url.path", info.Path),
+			stringAttribute("http.route", info.Route),
+			intAttribute("http.response.status_code", info.StatusCode),
+		},
+	}
+	if info.ErrorCode != "" {
+		server.Attributes = append(server.Attributes, stringAttribute("error.type", info.ErrorCode))
+	}
+	if info.StatusCode >= 500 {
+		server.Status = &status{Code: statusError}
+	}
+
+	spans := []*span{server, {
+		TraceID:      trace.TraceID,
+		SpanID:       newID(8),
+		ParentSpanID: trace.SpanID,
+		Name:         "directors",
+		Kind:         kindInternal,
+		Start:        unixNano(info.Start),
+		End:          unixNano(directorsEnd),
+	}}
+
+	if !info.UpstreamStart.IsZero() {
+		spans = append(spans, &span{
+			TraceID:      trace.TraceID,
+			SpanID:       trace.UpstreamSpanID,
+			ParentSpanID: trace.SpanID,
+			Name:         "upstream",
+			Kind:         kindClient,
+			Start:        unixNano(info.UpstreamStart),
+			End:          unixNano(info.UpstreamStart.Add(info.UpstreamDuration)),
+			Attributes: []attribute{
+				stringAttribute("server.address", info.Upstream),
+			},
+		})
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+	if t.closed {
+		return
+	}
+
+	for _, s := range spans {
+		select {
+		case t.spans <- s:
+		default:
+			// the collector is too slow, drop the span
+		}
+	}
+}
+
+// Close exports the buffered spans and stops the Tracer.
+func (t *Tracer) Close() error {
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return errors.New("tracer is already closed")
+	}
+	t.closed = true
+	close(t.spans)
+	t.Unlock()
+
+	<-t.done
+	return nil
+}
+
+func (t *Tracer) export() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.options.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, t.options.BatchSize)
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.send(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= t.options.BatchSize {
+				t.send(batch)
+				batch = batch[:0]
+			}
+
+		case <-ticker.C:
+			t.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// send posts the spans to the collector as an OTLP/HTTP JSON request.
+func (t *Tracer) send(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(&exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{
+				Attributes: []attribute{stringAttribute("service.name", t.options.ServiceName)},
+			},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: "github.com/zgiber/proxy/tracing"},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	resp, err := t.options.Client.Post(t.options.Collector, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("exporting spans: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("exporting spans: collector responded %s", resp.Status)
+	}
+}
+
+// The OTLP/HTTP JSON encoding of spans.
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope   `json:"scope"`
+	Spans []*span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []attribute `json:"attributes,omitempty"`
+	Status       *status     `json:"status,omitempty"`
+}
+
+type status struct {
+	Code int `json:"code"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value attributeValue `json:"value"`
+}
+
+type attributeValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is encoded as a string
+}
+
+func stringAttribute(key, value string) attribute {
+	return attribute{Key: key, Value: attributeValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) attribute {
+	v := strconv.Itoa(value)
+	return attribute{Key: key, Value: attributeValue{IntValue: &v}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
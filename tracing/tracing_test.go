@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zgiber/proxy"
+	"github.com/zgiber/proxy/directors"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tt := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"garbage", false, false},
+		{"", false, false},
+	}
+
+	for _, tc := range tt {
+		_, _, sampled, ok := parseTraceParent(tc.header)
+		if ok != tc.ok || sampled != tc.sampled {
+			t.Errorf("%q: expected ok:%v sampled:%v, got ok:%v sampled:%v", tc.header, tc.ok, tc.sampled, ok, sampled)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var mu sync.Mutex
+	var exported []*span
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		request := exportRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range request.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				exported = append(exported, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamHeader = req.Header
+	}))
+	defer upstream.Close()
+
+	tracer := NewTracer(Options{Collector: collector.URL})
+	reverseProxy := proxy.New()
+	reverseProxy.AddDirector(directors.Chain(Director, directors.NewSingleHost(upstream.URL)))
+	reverseProxy.AddObserver(tracer.Observe)
+
+	req := httptest.NewRequest("GET", "http://localhost/hello", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=value")
+	reverseProxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	traceParent := upstreamHeader.Get("traceparent")
+	if !strings.HasPrefix(traceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(traceParent, "00f067aa0ba902b7") {
+		t.Fatalf("Expected a child of the incoming trace, got traceparent %q", traceParent)
+	}
+	if tracestate := upstreamHeader.Get("tracestate"); tracestate != "vendor=value" {
+		t.Fatalf("Expected tracestate to be passed on, got %q", tracestate)
+	}
+
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	spans := map[string]*span{}
+	for _, s := range exported {
+		spans[s.Name] = s
+	}
+	if len(exported) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(exported))
+	}
+
+	server, upstreamSpan := spans["GET"], spans["upstream"]
+	if server == nil || upstreamSpan == nil || spans["directors"] == nil {
+		t.Fatalf("Unexpected spans: %v", spans)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("Expected the server span to continue the trace, got %+v", server)
+	}
+	if upstreamSpan.ParentSpanID != server.SpanID || !strings.Contains(traceParent, upstreamSpan.SpanID) {
+		t.Fatalf("Expected the upstream span to be propagated, got %+v", upstreamSpan)
+	}
+}